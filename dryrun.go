@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+// runDryRun prints what a migration with config would do. It only reads from
+// the source and never creates the SQLite file or its directory.
+func runDryRun(ctx context.Context, config Config) (err error) {
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+	defer func() { err = stopError(ctx, err) }()
+
+	encrypted, err := config.encryptedPolicy()
+	if err != nil {
+		return err
+	}
+	orphans, err := config.orphanPolicy()
+	if err != nil {
+		return err
+	}
+
+	src, err := openSource(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	m := pg2sqlite.New(src, nil, pg2sqlite.Options{Encrypted: encrypted, Orphans: orphans, Filter: config.filter(), Logf: logln})
+	plan, err := m.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(config.SqlitePath); err == nil {
+		plan.Problems = append(plan.Problems, pg2sqlite.PlanProblem{
+			Message:  fmt.Sprintf("SQLite database already exists at %s", config.SqlitePath),
+			Blocking: true,
+		})
+	}
+
+	fmt.Println("\nDry run - nothing has been written")
+	fmt.Printf("\nMigration Plan (into %s):\n", config.SqlitePath)
+	var totalRows int
+	var totalBytes int64
+	for _, t := range plan.Tables {
+		fmt.Printf("  %-9s %9d rows  %10s\n", t.Name+":", t.Rows, formatBytes(t.Bytes))
+		totalRows += t.Rows
+		totalBytes += t.Bytes
+	}
+	fmt.Printf("  %-9s %9d rows  %10s\n", "Total:", totalRows, formatBytes(totalBytes))
+
+	if len(plan.Problems) == 0 {
+		fmt.Println("\nNo problems found")
+		return nil
+	}
+
+	blocking := 0
+	fmt.Printf("\nProblems (%d):\n", len(plan.Problems))
+	for _, p := range plan.Problems {
+		kind := "warning"
+		if p.Blocking {
+			kind = "error"
+			blocking++
+		}
+		if p.Table != "" {
+			fmt.Printf("  [%s] %s: %s\n", kind, p.Table, p.Message)
+		} else {
+			fmt.Printf("  [%s] %s\n", kind, p.Message)
+		}
+	}
+
+	if blocking > 0 {
+		return fmt.Errorf("dry run found %d problems that would make the migration fail", blocking)
+	}
+
+	return nil
+}
+
+// formatBytes renders an approximate data size, such as "1.5 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
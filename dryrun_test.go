@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunWritesNothing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(dir, "server.db"),
+		DryRun:     true,
+	}
+
+	if err := runDryRun(context.Background(), config); err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to be created, got %v", dir, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDump is an excerpt of a plain-format pg_dump of a Dnote v2 database.
+// It is shared with the pg2sqlite package tests.
+var testDump = func() string {
+	b, err := os.ReadFile(filepath.Join("pg2sqlite", "testdata", "v2.sql"))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}()
+
+func writeTestDump(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write dump: %v", err)
+	}
+
+	return path
+}
+
+func TestMigrationFromDump(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+		BatchSize:  1,
+		Workers:    3,
+	}
+
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", config.SqlitePath)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	for table, expected := range map[string]int{
+		"users": 2, "accounts": 2, "books": 1, "notes": 2, "tokens": 1, "sessions": 1,
+	} {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Fatalf("Failed to count %s: %v", table, err)
+		}
+		if count != expected {
+			t.Errorf("%s: expected %d rows, got %d", table, expected, count)
+		}
+	}
+
+	var body string
+	var public bool
+	if err := db.QueryRow("SELECT body, public FROM notes WHERE id = 1").Scan(&body, &public); err != nil {
+		t.Fatalf("Failed to query note 1: %v", err)
+	}
+	if body != "# golang\nuse \\n for newlines" {
+		t.Errorf("note 1 body: got %q", body)
+	}
+	if !public {
+		t.Error("note 1 public: expected true")
+	}
+
+	var createdAt time.Time
+	if err := db.QueryRow("SELECT created_at FROM users WHERE id = 1").Scan(&createdAt); err != nil {
+		t.Fatalf("Failed to query user 1: %v", err)
+	}
+	expectedCreatedAt := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	if !createdAt.Equal(expectedCreatedAt) {
+		t.Errorf("user 1 created_at: expected %v, got %v", expectedCreatedAt, createdAt)
+	}
+
+	var ftsNoteID int
+	if err := db.QueryRow("SELECT rowid FROM notes_fts WHERE notes_fts MATCH 'second'").Scan(&ftsNoteID); err != nil {
+		t.Fatalf("Failed to query notes_fts: %v", err)
+	}
+	if ftsNoteID != 3 {
+		t.Errorf("notes_fts MATCH second: expected 3, got %d", ftsNoteID)
+	}
+}
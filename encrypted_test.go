@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+// encryptedTestDump adds an encrypted book to testDump and marks note 3 as
+// encrypted.
+func encryptedTestDump() string {
+	dump := strings.Replace(testDump,
+		"1	golang	1704164645	1704164645	1	f	f\n",
+		"1	golang	1704164645	1704164645	1	f	f\n"+
+			"2	2024-01-02 03:04:05+00	2024-01-02 03:04:05+00	5e6f7a8b-5d6e-4f70-8a9b-0c1d2e3f4a5b	1	Y2lwaGVydGV4dA==	1704164645	1704164645	4	f	t\n", 1)
+	return strings.Replace(dump, "	f	3	f	f	web\n", "	f	3	f	t	web\n", 1)
+}
+
+func countRows(t *testing.T, path, table string) int {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		t.Fatalf("Failed to count %s: %v", table, err)
+	}
+
+	return count
+}
+
+func TestEncryptedFail(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, encryptedTestDump()),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+	}
+
+	err := run(context.Background(), config)
+	if err == nil {
+		t.Fatal("expected the migration to fail on encrypted rows by default")
+	}
+	if !strings.Contains(err.Error(), "found 1 encrypted books and 1 encrypted notes") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(config.SqlitePath); !os.IsNotExist(err) {
+		t.Errorf("expected no SQLite file to be created, got %v", err)
+	}
+}
+
+func TestEncryptedSkip(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		PgDumpFile:      writeTestDump(t, encryptedTestDump()),
+		SqlitePath:      filepath.Join(dir, "server.db"),
+		Encrypted:       "skip",
+		EncryptedExport: filepath.Join(dir, "encrypted.jsonl"),
+	}
+
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	if n := countRows(t, config.SqlitePath, "books"); n != 1 {
+		t.Errorf("books: expected 1, got %d", n)
+	}
+	if n := countRows(t, config.SqlitePath, "notes"); n != 1 {
+		t.Errorf("notes: expected 1, got %d", n)
+	}
+
+	f, err := os.Open(config.EncryptedExport)
+	if err != nil {
+		t.Fatalf("Failed to open export: %v", err)
+	}
+	defer f.Close()
+
+	var records []pg2sqlite.EncryptedRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r pg2sqlite.EncryptedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Failed to parse export line: %v", err)
+		}
+		records = append(records, r)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("export: expected 2 records, got %d", len(records))
+	}
+	if records[0].Table != "books" || records[0].ID != 2 || records[0].Label != "Y2lwaGVydGV4dA==" {
+		t.Errorf("export[0]: unexpected %+v", records[0])
+	}
+	if records[1].Table != "notes" || records[1].ID != 3 || records[1].Body != "second\tnote" {
+		t.Errorf("export[1]: unexpected %+v", records[1])
+	}
+}
+
+func TestEncryptedKeep(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, encryptedTestDump()),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+		Encrypted:  "keep",
+	}
+
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	if n := countRows(t, config.SqlitePath, "books"); n != 2 {
+		t.Errorf("books: expected 2, got %d", n)
+	}
+	if n := countRows(t, config.SqlitePath, "notes"); n != 2 {
+		t.Errorf("notes: expected 2, got %d", n)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestListFlag(t *testing.T) {
+	var values []string
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(listFlag{&values}, "tables", "")
+
+	if err := fs.Parse([]string{"--tables", "users, accounts", "--tables=books"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if fmt.Sprint(values) != "[users accounts books]" {
+		t.Errorf("Expected [users accounts books], got %v", values)
+	}
+}
+
+func TestMigrateOneUser(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+		UserEmails: []string{"user1@example.com"},
+		SkipTables: []string{"sessions", "tokens"},
+	}
+
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	for table, expected := range map[string]int{
+		"users": 1, "accounts": 1, "books": 1, "notes": 2, "tokens": 0, "sessions": 0,
+	} {
+		if n := countRows(t, config.SqlitePath, table); n != expected {
+			t.Errorf("%s: expected %d rows, got %d", table, expected, n)
+		}
+	}
+
+	config.SqlitePath = filepath.Join(t.TempDir(), "server.db")
+	config.SkipTables = []string{"users"}
+	if err := validate(config); err == nil {
+		t.Error("expected skipping users to be rejected")
+	}
+}
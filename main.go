@@ -1,53 +1,445 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 type Config struct {
 	PgHost     string
 	PgPort     string
 	PgDatabase string
 	PgUser     string
 	PgPassword string
+
+	// PgPasswordFile and PgPasswordStdin keep the password out of argv
+	PgPasswordFile  string
+	PgPasswordStdin bool
+
+	// PgURL and PgService supply the settings not given individually, see
+	// resolveConnection
+	PgURL         string
+	PgService     string
+	PgSSLMode     string
+	PgSSLRootCert string
+	PgSSLCert     string
+	PgSSLKey      string
+
+	PgDumpFile string
 	SqlitePath string
+	Resume     bool
+	BatchSize  int
+
+	// Workers is the number of tables read from the source at once
+	Workers int
+
+	// Merge adds the source to the existing database at SqlitePath instead
+	// of creating a new one
+	Merge bool
+
+	// SyncSince brings the existing database at SqlitePath up to date with
+	// the rows changed since this RFC 3339 time, or since the last run if
+	// it is "last"
+	SyncSince string
+
+	// Encrypted is the pg2sqlite.EncryptedPolicy for client-encrypted books
+	// and notes
+	Encrypted       string
+	EncryptedExport string
+
+	// Orphans is the pg2sqlite.OrphanPolicy for rows that reference a
+	// missing user or book
+	Orphans string
+
+	// UserUUIDs and UserEmails limit the migration to some users, and
+	// Tables and SkipTables to some tables, see pg2sqlite.Filter
+	UserUUIDs  []string
+	UserEmails []string
+	Tables     []string
+	SkipTables []string
+
+	// Progress is how the copy of each table is reported: auto, bar, log,
+	// json or none
+	Progress string
+
+	// Report is where to write the JSON record of the run, if set
+	Report string
+
+	// Timeout stops the run once it has taken this long, if set
+	Timeout time.Duration
+
+	// KeepFailed keeps the partial output of a failed run for debugging
+	KeepFailed bool
+
+	// DryRun reads the source and reports what would be migrated without
+	// writing anything
+	DryRun bool
+}
+
+// defaultEncryptedPolicy makes the operator decide about encrypted rows
+// rather than losing them silently.
+const defaultEncryptedPolicy = pg2sqlite.EncryptedFail
+
+// encryptedPolicy returns the policy for encrypted rows, falling back to the
+// default when none was given.
+func (c Config) encryptedPolicy() (pg2sqlite.EncryptedPolicy, error) {
+	if c.Encrypted == "" {
+		return defaultEncryptedPolicy, nil
+	}
+
+	policy, err := pg2sqlite.ParseEncryptedPolicy(c.Encrypted)
+	if err != nil {
+		return "", fmt.Errorf("--encrypted: %w", err)
+	}
+
+	return policy, nil
+}
+
+// defaultOrphanPolicy makes the operator decide about orphaned rows, which
+// the v3 schema cannot hold.
+const defaultOrphanPolicy = pg2sqlite.OrphanFail
+
+// orphanPolicy returns the policy for orphaned rows, falling back to the
+// default when none was given.
+func (c Config) orphanPolicy() (pg2sqlite.OrphanPolicy, error) {
+	if c.Orphans == "" {
+		return defaultOrphanPolicy, nil
+	}
+
+	policy, err := pg2sqlite.ParseOrphanPolicy(c.Orphans)
+	if err != nil {
+		return "", fmt.Errorf("--orphans: %w", err)
+	}
+
+	return policy, nil
+}
+
+// syncSince parses --sync-since: "last" gives the zero time, which makes
+// Sync start from the high-water mark recorded in the database, and
+// anything else must be an RFC 3339 time to sync from.
+func (c Config) syncSince() (time.Time, error) {
+	if c.SyncSince == "last" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, c.SyncSince)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --sync-since %q: must be \"last\" or an RFC 3339 time such as 2024-06-01T12:00:00Z", c.SyncSince)
+	}
+
+	return t, nil
+}
+
+// filter returns the users and tables selected by config.
+func (c Config) filter() pg2sqlite.Filter {
+	return pg2sqlite.Filter{
+		UserUUIDs:  c.UserUUIDs,
+		UserEmails: c.UserEmails,
+		Tables:     c.Tables,
+		SkipTables: c.SkipTables,
+	}
+}
+
+// listFlag collects the values of a flag that can be repeated or given a
+// comma-separated list, or both.
+type listFlag struct {
+	values *[]string
+}
+
+func (f listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+
+	return strings.Join(*f.values, ",")
+}
+
+func (f listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f.values = append(*f.values, v)
+		}
+	}
+
+	return nil
+}
+
+func registerFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.PgHost, "pg-host", "", "PostgreSQL host")
+	fs.StringVar(&config.PgPort, "pg-port", "", "PostgreSQL port (default "+defaultPgPort+")")
+	fs.StringVar(&config.PgDatabase, "pg-database", "", "PostgreSQL database name")
+	fs.StringVar(&config.PgUser, "pg-user", "", "PostgreSQL user")
+	fs.StringVar(&config.PgPassword, "pg-password", "", "PostgreSQL password (visible to other users in ps; prefer --pg-password-file)")
+	fs.StringVar(&config.PgPasswordFile, "pg-password-file", "", "Read the PostgreSQL password from this file")
+	fs.BoolVar(&config.PgPasswordStdin, "pg-password-stdin", false, "Read the PostgreSQL password from stdin")
+	fs.StringVar(&config.PgURL, "pg-url", "", "PostgreSQL connection URL, such as postgres://user@host:5432/dnote?sslmode=require")
+	fs.StringVar(&config.PgService, "pg-service", "", "Connection service name from pg_service.conf")
+	fs.StringVar(&config.PgSSLMode, "pg-sslmode", "", "PostgreSQL SSL mode: disable, require, verify-ca or verify-full (default "+defaultSSLMode+")")
+	fs.StringVar(&config.PgSSLRootCert, "pg-sslrootcert", "", "Certificate authority file for verifying the server")
+	fs.StringVar(&config.PgSSLCert, "pg-sslcert", "", "Client certificate file")
+	fs.StringVar(&config.PgSSLKey, "pg-sslkey", "", "Client private key file")
+	fs.StringVar(&config.SqlitePath, "sqlite-path", "", "SQLite database path")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sqlite2pg" {
+		sqlite2pgMain(os.Args[2:])
+		return
+	}
+
 	var config Config
 
-	flag.StringVar(&config.PgHost, "pg-host", "", "PostgreSQL host")
-	flag.StringVar(&config.PgPort, "pg-port", "5432", "PostgreSQL port")
-	flag.StringVar(&config.PgDatabase, "pg-database", "", "PostgreSQL database name")
-	flag.StringVar(&config.PgUser, "pg-user", "", "PostgreSQL user")
-	flag.StringVar(&config.PgPassword, "pg-password", "", "PostgreSQL password")
-	flag.StringVar(&config.SqlitePath, "sqlite-path", "", "SQLite database path")
+	registerFlags(flag.CommandLine, &config)
+	flag.StringVar(&config.PgDumpFile, "pg-dump-file", "", "Read from a plain-format pg_dump file instead of a PostgreSQL server")
+	flag.BoolVar(&config.Resume, "resume", false, "Continue an interrupted migration from the checkpoints in its partial output")
+	flag.BoolVar(&config.Merge, "merge", false, "Add the source to the existing Dnote v3 database at --sqlite-path instead of creating a new one")
+	flag.StringVar(&config.SyncSince, "sync-since", "", "Copy the rows changed since this RFC 3339 time, or since the last migration or sync with \"last\", into the existing database at --sqlite-path")
+	flag.IntVar(&config.BatchSize, "batch-size", pg2sqlite.DefaultBatchSize, "Number of rows copied per checkpointed transaction")
+	flag.IntVar(&config.Workers, "workers", 1, "Number of tables read from the source at once, ahead of the table being written")
+	flag.StringVar(&config.Encrypted, "encrypted", string(defaultEncryptedPolicy), "How to handle client-encrypted books and notes: skip, keep or fail")
+	flag.StringVar(&config.EncryptedExport, "encrypted-export", "", "Write encrypted books and notes skipped by --encrypted=skip to this JSON lines file")
+	flag.StringVar(&config.Orphans, "orphans", string(defaultOrphanPolicy), "How to handle rows that reference a missing user or book: drop, reparent or fail")
+	flag.Var(listFlag{&config.UserUUIDs}, "user-uuid", "Only migrate the user with this uuid, and their data (repeatable)")
+	flag.Var(listFlag{&config.UserEmails}, "user-email", "Only migrate the user whose account has this email, and their data (repeatable)")
+	flag.Var(listFlag{&config.Tables}, "tables", "Comma-separated tables to migrate (default all): users, accounts, books, notes, tokens, sessions")
+	flag.Var(listFlag{&config.SkipTables}, "skip-tables", "Comma-separated tables to leave out, such as sessions,tokens")
+	flag.StringVar(&config.Progress, "progress", progressAuto, "How to report progress: auto (a bar on a terminal, log lines otherwise), bar, log, json or none")
+	flag.StringVar(&config.Report, "report", "", "Write a JSON report of the migration to this file")
+	flag.DurationVar(&config.Timeout, "timeout", 0, "Stop the migration if it takes longer than this, such as 30m or 2h (default no limit)")
+	flag.BoolVar(&config.KeepFailed, "keep-failed", false, "Keep the partial output of a failed migration instead of removing it")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Report what would be migrated and any problems, without writing anything")
 	flag.Parse()
 
+	if err := resolve(&config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	if err := validate(config); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if err := run(config); err != nil {
+	// Wrappers reading events from stdout get everything else on stderr
+	if config.Progress == progressJSON && !config.DryRun {
+		out = os.Stderr
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if config.DryRun {
+		if err := runDryRun(ctx, config); err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		return
+	}
+
+	if config.SyncSince != "" {
+		if err := run(ctx, config); err != nil {
+			log.Fatalf("Sync failed: %v", err)
+		}
+		fmt.Fprintln(out, "Sync completed successfully!")
+		return
+	}
+
+	if err := run(ctx, config); err != nil {
 		log.Fatalf("Migration failed: %v", err)
 	}
 
-	fmt.Println("Migration completed successfully!")
+	fmt.Fprintln(out, "Migration completed successfully!")
+}
+
+// verifyMain implements the verify subcommand. It writes the JSON report to
+// stdout, or to --output, and exits with status 2 if the databases differ.
+func verifyMain(args []string) {
+	var config Config
+	var output string
+
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	registerFlags(fs, &config)
+	fs.StringVar(&output, "output", "", "Write the JSON report to this path instead of stdout")
+	fs.Parse(args)
+
+	if err := resolve(&config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validate(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	report, err := runVerify(ctx, config)
+	if err != nil {
+		log.Fatalf("Verification failed: %v", err)
+	}
+
+	out := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Fatalf("Creating report file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("Writing report: %v", err)
+	}
+
+	for _, t := range report.Tables {
+		fmt.Fprintf(os.Stderr, "  %-9s source=%d target=%d missing=%d extra=%d mismatched=%d\n",
+			t.Table+":", t.SourceRows, t.TargetRows, len(t.MissingIDs), len(t.ExtraIDs), len(t.MismatchedRows))
+	}
+
+	if !report.OK {
+		fmt.Fprintln(os.Stderr, "Verification found differences")
+		os.Exit(2)
+	}
+
+	fmt.Fprintln(os.Stderr, "Verification passed")
+}
+
+// resolve completes config from sources other than flags, so that validate
+// sees the settings that will actually be used.
+func resolve(config *Config) error {
+	// A dump file replaces the connection entirely
+	if config.PgDumpFile != "" {
+		return nil
+	}
+
+	if err := readPasswordFlags(config, os.Stdin); err != nil {
+		return err
+	}
+	if err := resolveConnection(config, os.Getenv); err != nil {
+		return err
+	}
+
+	// Ask only once every other source of the password has come up empty, and
+	// not for settings that validate is about to reject
+	if config.PgPassword == "" && !config.PgPasswordStdin && config.PgHost != "" && config.PgUser != "" {
+		return promptPassword(config)
+	}
+
+	return nil
+}
+
+// signalContext returns a context that is canceled when the process receives
+// SIGINT or SIGTERM, with the signal as its cause. Once it is canceled, a
+// second signal kills the process as usual.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			fmt.Fprintf(os.Stderr, "\nReceived %s, stopping...\n", sig)
+			cancel(fmt.Errorf("stopped by %s signal", sig))
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// withTimeout applies --timeout to ctx.
+func (c Config) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeoutCause(ctx, c.Timeout, fmt.Errorf("timed out after %s", c.Timeout))
+}
+
+// stopError explains err when it was caused by ctx being done, so that
+// "context canceled" says which signal or timeout it came from.
+func stopError(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+
+	cause := context.Cause(ctx)
+	if cause == ctx.Err() {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", cause, err)
 }
 
 func validate(c Config) error {
+	if _, err := c.encryptedPolicy(); err != nil {
+		return err
+	}
+	if c.EncryptedExport != "" && c.Encrypted != string(pg2sqlite.EncryptedSkip) {
+		return fmt.Errorf("--encrypted-export requires --encrypted=skip")
+	}
+	if _, err := c.orphanPolicy(); err != nil {
+		return err
+	}
+	if err := c.filter().Validate(); err != nil {
+		return err
+	}
+	if c.Progress != "" && !validProgressMode(c.Progress) {
+		return fmt.Errorf("--progress must be auto, bar, log, json or none")
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("--workers must not be negative")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+	if c.SyncSince != "" {
+		if _, err := c.syncSince(); err != nil {
+			return err
+		}
+		if c.Merge || c.Resume || c.DryRun {
+			return fmt.Errorf("--sync-since cannot be combined with --merge, --resume or --dry-run")
+		}
+	}
+	if c.Merge && c.Resume {
+		return fmt.Errorf("--merge cannot be combined with --resume: a failed merge leaves the existing database untouched, so rerun it instead")
+	}
+
+	if c.PgDumpFile != "" {
+		if c.SqlitePath == "" {
+			return fmt.Errorf("--sqlite-path is required")
+		}
+		return nil
+	}
+
 	if c.PgHost == "" {
 		return fmt.Errorf("--pg-host is required")
 	}
@@ -57,82 +449,321 @@ func validate(c Config) error {
 	if c.PgUser == "" {
 		return fmt.Errorf("--pg-user is required")
 	}
+	switch c.PgSSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("unsupported --pg-sslmode %q: must be disable, require, verify-ca or verify-full", c.PgSSLMode)
+	}
 	if c.SqlitePath == "" {
 		return fmt.Errorf("--sqlite-path is required")
 	}
 	return nil
 }
 
-func run(config Config) error {
+// run migrates the source described by config into a new SQLite database.
+// Once ctx is done, the batch being copied is rolled back and the partial
+// output is removed, or kept for --resume as after any other failure.
+func run(ctx context.Context, config Config) (err error) {
+	started := time.Now()
+	var result *pg2sqlite.Result
+	if config.Report != "" {
+		defer func() {
+			reportErr := writeReport(config, started, result, err)
+			if reportErr != nil && err == nil {
+				err = fmt.Errorf("writing report: %w", reportErr)
+			} else if reportErr != nil {
+				fmt.Fprintf(os.Stderr, "Warning: writing report: %v\n", reportErr)
+			}
+		}()
+	}
+
+	ctx, cancel := config.withTimeout(ctx)
+	defer cancel()
+	defer func() { err = stopError(ctx, err) }()
+
+	if config.SyncSince != "" {
+		result, err = runSync(ctx, config)
+		return err
+	}
+
+	// Check if SQLite file already exists, which it has to when merging
+	if _, err := os.Stat(config.SqlitePath); err == nil && !config.Merge {
+		return fmt.Errorf("SQLite database already exists at %s - refusing to overwrite. Please remove the file or choose a different path, or pass --merge to add to it", config.SqlitePath)
+	} else if os.IsNotExist(err) && config.Merge {
+		return fmt.Errorf("no SQLite database to merge into at %s", config.SqlitePath)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("checking if SQLite file exists: %w", err)
+	}
+
+	// The migration is built in a partial file next to the target, which an
+	// interrupted run leaves behind
+	partial := partialPath(config.SqlitePath)
+	resuming := false
+	if _, err := os.Stat(partial); err == nil {
+		if config.Merge {
+			return fmt.Errorf("found the partial output of an earlier run at %s - remove it to merge", partial)
+		}
+		if !config.Resume {
+			return fmt.Errorf("found an unfinished migration at %s - pass --resume to continue it, or remove the file to start over", partial)
+		}
+		resuming = true
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("checking for an unfinished migration: %w", err)
+	}
+
+	encrypted, err := config.encryptedPolicy()
+	if err != nil {
+		return err
+	}
+	orphans, err := config.orphanPolicy()
+	if err != nil {
+		return err
+	}
+
+	// Connect to PostgreSQL, or index the dump file
+	src, err := openSource(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Opening does not create the file; that waits for the first connection
+	sqliteDB, err := sql.Open("sqlite3", partial+"?"+pg2sqlite.SQLiteLoadParams)
+	if err != nil {
+		return fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer sqliteDB.Close()
+
+	// A single connection keeps the per-connection pragmas in effect and
+	// serializes writes
+	sqliteDB.SetMaxOpenConns(1)
+
+	opts := pg2sqlite.Options{
+		BatchSize: config.BatchSize,
+		Workers:   config.Workers,
+		Encrypted: encrypted,
+		Orphans:   orphans,
+		Filter:    config.filter(),
+		Merge:     config.Merge,
+		Progress:  newProgressReporter(config.Progress, os.Stdout),
+		Logf:      logln,
+	}
+	if config.EncryptedExport != "" {
+		export := &exportFile{path: config.EncryptedExport}
+		defer export.Close()
+
+		opts.EncryptedExport = export
+	}
+
+	m := pg2sqlite.New(src, sqliteDB, opts)
+
+	// Make sure the source can be migrated before creating anything
+	if err := m.Check(ctx); err != nil {
+		return err
+	}
+
 	// Create directory if it doesn't exist
 	dir := filepath.Dir(config.SqlitePath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return fmt.Errorf("creating database directory at %s: %w", dir, err)
 	}
 
-	// Check if SQLite file already exists
-	if _, err := os.Stat(config.SqlitePath); err == nil {
-		return fmt.Errorf("SQLite database already exists at %s - refusing to overwrite. Please remove the file or choose a different path", config.SqlitePath)
-	} else if !os.IsNotExist(err) {
-		return fmt.Errorf("checking if SQLite file exists: %w", err)
+	// A merge is built on a copy of the existing database, which is only
+	// replaced once the merge has succeeded
+	var journalMode string
+	if config.Merge {
+		fmt.Fprintf(out, "Copying %s to merge into\n", config.SqlitePath)
+		journalMode, err = copySQLite(ctx, config.SqlitePath, partial)
+		if err != nil {
+			removeSQLite(partial)
+			return fmt.Errorf("copying the database to merge into: %w", err)
+		}
+	}
+
+	result, err = build(ctx, m, sqliteDB, partial, resuming, journalMode)
+	sqliteDB.Close()
+	if err != nil {
+		// A partial file from an earlier run is left for the next --resume
+		if config.Merge && config.KeepFailed {
+			fmt.Fprintf(os.Stderr, "Partial output kept at %s\n", partial)
+		} else if config.KeepFailed || resuming {
+			fmt.Fprintf(os.Stderr, "Partial output kept at %s - rerun with --resume to continue\n", partial)
+		} else if rmErr := removeSQLite(partial); rmErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: removing partial output: %v\n", rmErr)
+		}
+
+		return err
+	}
+
+	// Only a complete, checked database ever appears at the target path
+	if err := commitOutput(partial, config.SqlitePath); err != nil {
+		return fmt.Errorf("moving database into place: %w", err)
+	}
+
+	printSummary("Migration Summary", result, encrypted)
+	return nil
+}
+
+// build runs the migration into the SQLite database at path, which m writes
+// to through db, and leaves it ready to be moved into place. A merged
+// database is given back journalMode, the mode of the database it replaces.
+func build(ctx context.Context, m *pg2sqlite.Migrator, db *sql.DB, path string, resuming bool, journalMode string) (*pg2sqlite.Result, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("pinging SQLite: %w", err)
 	}
 
-	// Connect to PostgreSQL
-	pgDSN := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s sslmode=disable",
-		config.PgHost, config.PgPort, config.PgDatabase, config.PgUser, config.PgPassword)
+	fmt.Fprintln(out, "Connected to SQLite")
 
-	pgDB, err := sql.Open("postgres", pgDSN)
+	// Only resume files that an interrupted migration left behind
+	if resuming {
+		ok, err := pg2sqlite.HasCheckpoints(ctx, db)
+		if err != nil {
+			return nil, fmt.Errorf("checking for checkpoints: %w", err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("SQLite database at %s has no migration checkpoints - it was not created by this tool", path)
+		}
+
+		fmt.Fprintln(out, "Resuming interrupted migration")
+	}
+
+	result, err := m.Run(ctx)
 	if err != nil {
-		return fmt.Errorf("connecting to PostgreSQL: %w", err)
+		return nil, err
 	}
-	defer pgDB.Close()
 
-	if err := pgDB.Ping(); err != nil {
-		return fmt.Errorf("pinging PostgreSQL: %w", err)
+	// Fold the WAL back into the database file so it can be moved on its own
+	if _, err := db.ExecContext(ctx, "PRAGMA journal_mode=DELETE"); err != nil {
+		return nil, fmt.Errorf("switching off WAL: %w", err)
+	}
+
+	// Switching back only marks the file; its WAL is created on next open
+	if journalMode == "wal" {
+		if _, err := db.ExecContext(ctx, "PRAGMA journal_mode=WAL"); err != nil {
+			return nil, fmt.Errorf("restoring WAL: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// logln prints a step of the migration.
+func logln(format string, args ...any) {
+	fmt.Fprintf(out, format+"\n", args...)
+}
+
+func printSummary(title string, result *pg2sqlite.Result, encrypted pg2sqlite.EncryptedPolicy) {
+	stats := result.Stats
+
+	fmt.Fprintf(out, "\n%s:\n", title)
+	fmt.Fprintf(out, "  Users:    %d\n", stats.Users)
+	fmt.Fprintf(out, "  Accounts: %d\n", stats.Accounts)
+	fmt.Fprintf(out, "  Books:    %d\n", stats.Books)
+	fmt.Fprintf(out, "  Notes:    %d\n", stats.Notes)
+	fmt.Fprintf(out, "  Tokens:   %d\n", stats.Tokens)
+	fmt.Fprintf(out, "  Sessions: %d\n", stats.Sessions)
+	if stats.EncryptedBooks > 0 || stats.EncryptedNotes > 0 {
+		fmt.Fprintf(out, "  Encrypted books: %d (%s)\n", stats.EncryptedBooks, encrypted.Outcome())
+		fmt.Fprintf(out, "  Encrypted notes: %d (%s)\n", stats.EncryptedNotes, encrypted.Outcome())
+	}
+	if stats.UnverifiedAccounts > 0 {
+		fmt.Fprintf(out, "  Accounts no longer verified: %d (v3 does not record verified emails; ids %s)\n",
+			stats.UnverifiedAccounts, joinIDs(result.Unverified))
+	}
+	if orphans := stats.Orphans; orphans.Total() > 0 {
+		fmt.Fprintf(out, "  Orphaned rows: %d (%d dropped, %d notes moved into %d recovered books)\n",
+			orphans.Total(), orphans.Dropped, orphans.Reparented, orphans.RecoveredBooks)
+	}
+	var deleted int
+	for _, t := range result.Tables {
+		deleted += t.Deleted
+	}
+	if deleted > 0 {
+		fmt.Fprintf(out, "  Deleted:  %d rows no longer in the source\n", deleted)
+	}
+	if merge := result.Merge; merge != nil {
+		fmt.Fprintf(out, "  Merged: %d existing users matched by email, %d rows given new ids, %d books renamed\n",
+			len(merge.Users), len(merge.IDs), len(merge.Books))
+		for _, b := range merge.Books {
+			fmt.Fprintf(out, "    Book %q of user %d renamed to %q\n", b.From, b.UserID, b.To)
+		}
+	}
+}
+
+// summaryIDs is the number of ids printSummary lists before leaving the rest
+// to the --report.
+const summaryIDs = 10
+
+// joinIDs lists ids for the summary.
+func joinIDs(ids []int) string {
+	var s []string
+	for _, id := range ids[:min(len(ids), summaryIDs)] {
+		s = append(s, strconv.Itoa(id))
+	}
+	if len(ids) > summaryIDs {
+		s = append(s, "...")
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// runVerify compares an existing SQLite database with the Postgres database it
+// was migrated from. It never writes to either database.
+func runVerify(ctx context.Context, config Config) (*pg2sqlite.VerifyReport, error) {
+	if _, err := os.Stat(config.SqlitePath); err != nil {
+		return nil, fmt.Errorf("checking SQLite database: %w", err)
 	}
 
-	fmt.Println("Connected to PostgreSQL")
+	pgDB, err := openPostgres(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer pgDB.Close()
 
-	// Connect to SQLite with GORM
-	sqliteDB, err := sql.Open("sqlite3", config.SqlitePath)
+	sqliteDB, err := sql.Open("sqlite3", "file:"+config.SqlitePath+"?mode=ro")
 	if err != nil {
-		return fmt.Errorf("opening SQLite: %w", err)
+		return nil, fmt.Errorf("opening SQLite: %w", err)
 	}
 	defer sqliteDB.Close()
 
-	if err := sqliteDB.Ping(); err != nil {
-		return fmt.Errorf("pinging SQLite: %w", err)
+	if err := sqliteDB.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("pinging SQLite: %w", err)
 	}
 
-	fmt.Println("Connected to SQLite")
+	return pg2sqlite.Verify(ctx, pgDB, sqliteDB)
+}
+
+func openSource(ctx context.Context, config Config) (pg2sqlite.Source, error) {
+	if config.PgDumpFile != "" {
+		fmt.Fprintln(out, "Indexing pg_dump file...")
+		src, err := pg2sqlite.OpenDumpSource(ctx, config.PgDumpFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading pg_dump file: %w", err)
+		}
+
+		fmt.Fprintln(out, "Read pg_dump file")
+		return src, nil
+	}
 
-	// Initialize SQLite schema using GORM
-	fmt.Println("Creating SQLite schema...")
-	if err := initSQLiteSchema(config.SqlitePath); err != nil {
-		return fmt.Errorf("initializing SQLite schema: %w", err)
+	pgDB, err := openPostgres(ctx, config)
+	if err != nil {
+		return nil, err
 	}
 
-	// Run migration
-	return migrate(pgDB, sqliteDB)
+	fmt.Fprintln(out, "Connected to PostgreSQL")
+	return pg2sqlite.NewPostgresSource(pgDB), nil
 }
 
-func initSQLiteSchema(sqlitePath string) error {
-	db, err := gorm.Open(sqlite.Open(sqlitePath), &gorm.Config{})
+func openPostgres(ctx context.Context, config Config) (*sql.DB, error) {
+	pgDB, err := sql.Open("postgres", postgresDSN(config))
 	if err != nil {
-		return fmt.Errorf("opening SQLite with GORM: %w", err)
+		return nil, fmt.Errorf("connecting to PostgreSQL: %w", redactError(err, config))
 	}
 
-	// AutoMigrate SQLite models
-	if err := db.AutoMigrate(
-		&SqliteUser{},
-		&SqliteAccount{},
-		&SqliteBook{},
-		&SqliteNote{},
-		&SqliteToken{},
-		&SqliteSession{},
-	); err != nil {
-		return fmt.Errorf("running AutoMigrate: %w", err)
+	if err := pgDB.PingContext(ctx); err != nil {
+		pgDB.Close()
+		return nil, fmt.Errorf("pinging PostgreSQL: %w", redactError(err, config))
 	}
 
-	return nil
+	return pgDB, nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// laterTestDump is testDump taken from a second server, where the same
+// people created new rows with new uuids.
+func laterTestDump(dump string) string {
+	return strings.NewReplacer(
+		"0b4a4d7e-", "0b4a4d7f-",
+		"7c9e6679-", "7c9e667a-",
+		"2f3a1b4c-", "2f3a1b4d-",
+		"d1c2b3a4-", "d1c2b3a5-",
+		"a1b2c3d4-", "a1b2c3d5-",
+	).Replace(dump)
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(dir, "server.db"),
+	}
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	// The target has to exist, and a failed merge leaves it as it was
+	config.Merge = true
+	config.PgDumpFile = writeTestDump(t, laterTestDump(brokenTestDump))
+	if err := run(context.Background(), config); err == nil {
+		t.Fatal("expected the merge to fail")
+	}
+	if n := countRows(t, config.SqlitePath, "notes"); n != 2 {
+		t.Errorf("notes after failed merge: expected 2, got %d", n)
+	}
+	if _, err := os.Stat(partialPath(config.SqlitePath)); !os.IsNotExist(err) {
+		t.Errorf("expected partial output to be removed, got %v", err)
+	}
+
+	// A server running in WAL mode gets its database back in WAL mode
+	db, err := sql.Open("sqlite3", config.SqlitePath)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		t.Fatalf("Failed to switch to WAL: %v", err)
+	}
+	db.Close()
+
+	config.PgDumpFile = writeTestDump(t, laterTestDump(testDump))
+	config.Report = filepath.Join(dir, "report.json")
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	if _, err := os.Stat(config.SqlitePath + "-wal"); !os.IsNotExist(err) {
+		t.Errorf("expected the WAL to be folded into the database, got %v", err)
+	}
+	db, err = sql.Open("sqlite3", config.SqlitePath)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatalf("Failed to read the journal mode: %v", err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("Expected the merged database to keep journal mode wal, got %q", journalMode)
+	}
+
+	for table, expected := range map[string]int{
+		"users": 3, "accounts": 3, "books": 2, "notes": 4, "tokens": 2, "sessions": 2,
+	} {
+		if n := countRows(t, config.SqlitePath, table); n != expected {
+			t.Errorf("%s: expected %d rows, got %d", table, expected, n)
+		}
+	}
+
+	r := readReport(t, config.Report)
+	if r.Merge == nil || len(r.Merge.Users) != 1 || len(r.Merge.IDs) != 7 || len(r.Merge.Books) != 1 {
+		t.Errorf("Expected 1 merged user, 7 new ids and 1 renamed book in the report, got %+v", r.Merge)
+	}
+
+	config.Resume = true
+	if err := validate(config); err == nil {
+		t.Error("expected --merge with --resume to be rejected")
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -47,12 +50,12 @@ func TestMigration(t *testing.T) {
 
 	// Create tables
 	if err := db.AutoMigrate(
-		&PgUser{},
-		&PgAccount{},
-		&PgBook{},
-		&PgNote{},
-		&PgToken{},
-		&PgSession{},
+		&pg2sqlite.PgUser{},
+		&pg2sqlite.PgAccount{},
+		&pg2sqlite.PgBook{},
+		&pg2sqlite.PgNote{},
+		&pg2sqlite.PgToken{},
+		&pg2sqlite.PgSession{},
 	); err != nil {
 		t.Fatalf("Failed to migrate schema: %v", err)
 	}
@@ -61,8 +64,8 @@ func TestMigration(t *testing.T) {
 	now := time.Now()
 	lastLogin := now.Add(-24 * time.Hour)
 
-	user1 := PgUser{
-		PgModel:     PgModel{CreatedAt: now, UpdatedAt: now},
+	user1 := pg2sqlite.PgUser{
+		PgModel:     pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		LastLoginAt: &lastLogin,
 		MaxUSN:      10,
 		Cloud:       true,
@@ -71,8 +74,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create user1: %v", err)
 	}
 
-	user2 := PgUser{
-		PgModel:     PgModel{CreatedAt: now, UpdatedAt: now},
+	user2 := pg2sqlite.PgUser{
+		PgModel:     pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		LastLoginAt: nil,
 		MaxUSN:      0,
 		Cloud:       false,
@@ -81,30 +84,30 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create user2: %v", err)
 	}
 
-	account1 := PgAccount{
-		PgModel:       PgModel{CreatedAt: now, UpdatedAt: now},
+	account1 := pg2sqlite.PgAccount{
+		PgModel:       pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:        user1.ID,
-		Email:         NullString{sql.NullString{String: "user1@example.com", Valid: true}},
+		Email:         pg2sqlite.NullString{NullString: sql.NullString{String: "user1@example.com", Valid: true}},
 		EmailVerified: true,
-		Password:      NullString{sql.NullString{String: "hashedpassword1", Valid: true}},
+		Password:      pg2sqlite.NullString{NullString: sql.NullString{String: "hashedpassword1", Valid: true}},
 	}
 	if err := db.Create(&account1).Error; err != nil {
 		t.Fatalf("Failed to create account1: %v", err)
 	}
 
-	account2 := PgAccount{
-		PgModel:       PgModel{CreatedAt: now, UpdatedAt: now},
+	account2 := pg2sqlite.PgAccount{
+		PgModel:       pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:        user2.ID,
-		Email:         NullString{sql.NullString{String: "user2@example.com", Valid: true}},
+		Email:         pg2sqlite.NullString{NullString: sql.NullString{String: "user2@example.com", Valid: true}},
 		EmailVerified: false,
-		Password:      NullString{sql.NullString{String: "hashedpassword2", Valid: true}},
+		Password:      pg2sqlite.NullString{NullString: sql.NullString{String: "hashedpassword2", Valid: true}},
 	}
 	if err := db.Create(&account2).Error; err != nil {
 		t.Fatalf("Failed to create account2: %v", err)
 	}
 
-	book1 := PgBook{
-		PgModel:  PgModel{CreatedAt: now, UpdatedAt: now},
+	book1 := pg2sqlite.PgBook{
+		PgModel:  pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:   user1.ID,
 		Label:    "golang",
 		AddedOn:  now.Unix(),
@@ -116,8 +119,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create book1: %v", err)
 	}
 
-	book2 := PgBook{
-		PgModel:  PgModel{CreatedAt: now, UpdatedAt: now},
+	book2 := pg2sqlite.PgBook{
+		PgModel:  pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:   user2.ID,
 		Label:    "javascript",
 		AddedOn:  now.Unix(),
@@ -129,8 +132,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create book2: %v", err)
 	}
 
-	note1 := PgNote{
-		PgModel:  PgModel{CreatedAt: now, UpdatedAt: now},
+	note1 := pg2sqlite.PgNote{
+		PgModel:  pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:   user1.ID,
 		BookUUID: book1.UUID,
 		Body:     "This is a test note about golang",
@@ -144,8 +147,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create note1: %v", err)
 	}
 
-	note2 := PgNote{
-		PgModel:  PgModel{CreatedAt: now, UpdatedAt: now},
+	note2 := pg2sqlite.PgNote{
+		PgModel:  pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:   user2.ID,
 		BookUUID: book2.UUID,
 		Body:     "JavaScript note",
@@ -159,8 +162,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create note2: %v", err)
 	}
 
-	token1 := PgToken{
-		PgModel: PgModel{CreatedAt: now, UpdatedAt: now},
+	token1 := pg2sqlite.PgToken{
+		PgModel: pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:  user1.ID,
 		Value:   "token123",
 		Type:    "access",
@@ -170,8 +173,8 @@ func TestMigration(t *testing.T) {
 		t.Fatalf("Failed to create token1: %v", err)
 	}
 
-	session1 := PgSession{
-		PgModel:    PgModel{CreatedAt: now, UpdatedAt: now},
+	session1 := pg2sqlite.PgSession{
+		PgModel:    pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
 		UserID:     user1.ID,
 		Key:        "session123",
 		LastUsedAt: now,
@@ -195,7 +198,7 @@ func TestMigration(t *testing.T) {
 		SqlitePath: sqlitePath,
 	}
 
-	if err := run(config); err != nil {
+	if err := run(context.Background(), config); err != nil {
 		t.Fatalf("Migration failed: %v", err)
 	}
 
@@ -207,7 +210,7 @@ func TestMigration(t *testing.T) {
 
 	// Verify SQLite data using GORM
 	// Verify user1
-	var sqliteUser1 SqliteUser
+	var sqliteUser1 pg2sqlite.SqliteUser
 	if err := sqliteDB.First(&sqliteUser1, user1.ID).Error; err != nil {
 		t.Fatalf("Failed to query user1: %v", err)
 	}
@@ -235,7 +238,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify user2
-	var sqliteUser2 SqliteUser
+	var sqliteUser2 pg2sqlite.SqliteUser
 	if err := sqliteDB.First(&sqliteUser2, user2.ID).Error; err != nil {
 		t.Fatalf("Failed to query user2: %v", err)
 	}
@@ -253,7 +256,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify account1
-	var sqliteAccount1 SqliteAccount
+	var sqliteAccount1 pg2sqlite.SqliteAccount
 	if err := sqliteDB.Where("user_id = ?", user1.ID).First(&sqliteAccount1).Error; err != nil {
 		t.Fatalf("Failed to query account1: %v", err)
 	}
@@ -277,7 +280,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify account2
-	var sqliteAccount2 SqliteAccount
+	var sqliteAccount2 pg2sqlite.SqliteAccount
 	if err := sqliteDB.Where("user_id = ?", user2.ID).First(&sqliteAccount2).Error; err != nil {
 		t.Fatalf("Failed to query account2: %v", err)
 	}
@@ -286,7 +289,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify book1
-	var sqliteBook1 SqliteBook
+	var sqliteBook1 pg2sqlite.SqliteBook
 	if err := sqliteDB.Where("user_id = ?", user1.ID).First(&sqliteBook1).Error; err != nil {
 		t.Fatalf("Failed to query book1: %v", err)
 	}
@@ -322,7 +325,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify note1
-	var sqliteNote1 SqliteNote
+	var sqliteNote1 pg2sqlite.SqliteNote
 	if err := sqliteDB.Where("user_id = ?", user1.ID).First(&sqliteNote1).Error; err != nil {
 		t.Fatalf("Failed to query note1: %v", err)
 	}
@@ -366,8 +369,17 @@ func TestMigration(t *testing.T) {
 		t.Errorf("Note1 UpdatedAt: expected %v, got %v", note1.UpdatedAt, sqliteNote1.UpdatedAt)
 	}
 
+	// Verify full-text search index
+	var ftsNoteIDs []int
+	if err := sqliteDB.Raw("SELECT rowid FROM notes_fts WHERE notes_fts MATCH ?", "golang").Scan(&ftsNoteIDs).Error; err != nil {
+		t.Fatalf("Failed to query notes_fts: %v", err)
+	}
+	if len(ftsNoteIDs) != 1 || ftsNoteIDs[0] != note1.ID {
+		t.Errorf("notes_fts MATCH golang: expected [%d], got %v", note1.ID, ftsNoteIDs)
+	}
+
 	// Verify token1
-	var sqliteToken1 SqliteToken
+	var sqliteToken1 pg2sqlite.SqliteToken
 	if err := sqliteDB.Where("user_id = ?", user1.ID).First(&sqliteToken1).Error; err != nil {
 		t.Fatalf("Failed to query token1: %v", err)
 	}
@@ -398,7 +410,7 @@ func TestMigration(t *testing.T) {
 	}
 
 	// Verify session1
-	var sqliteSession1 SqliteSession
+	var sqliteSession1 pg2sqlite.SqliteSession
 	if err := sqliteDB.Where("user_id = ?", user1.ID).First(&sqliteSession1).Error; err != nil {
 		t.Fatalf("Failed to query session1: %v", err)
 	}
@@ -424,10 +436,100 @@ func TestMigration(t *testing.T) {
 		t.Errorf("Session1 UpdatedAt: expected %v, got %v", session1.UpdatedAt, sqliteSession1.UpdatedAt)
 	}
 
+	// Verify the migration using the verify subcommand
+	report, err := runVerify(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !report.OK {
+		t.Errorf("Verify reported differences: %+v", report.Tables)
+	}
+
+	// Roll the migrated database back into an empty Postgres database
+	if err := db.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public;").Error; err != nil {
+		t.Fatalf("Failed to reset schema: %v", err)
+	}
+	if _, err := runSQLite2PG(context.Background(), config); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	report, err = runVerify(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Verify after rollback failed: %v", err)
+	}
+	if !report.OK {
+		t.Errorf("Verify after rollback reported differences: %+v", report.Tables)
+	}
+
+	var rolledBack pg2sqlite.PgNote
+	if err := db.First(&rolledBack, note1.ID).Error; err != nil {
+		t.Fatalf("Failed to find rolled back note1: %v", err)
+	}
+	if !strings.Contains(rolledBack.TSV, "'golang'") || rolledBack.Encrypted {
+		t.Errorf("Rolled back note1: expected a rebuilt tsv and no encryption, got %q and %v", rolledBack.TSV, rolledBack.Encrypted)
+	}
+
+	// A source keeps reading from the snapshot it took first, however the
+	// server changes afterwards
+	snapshotDB, err := sql.Open("postgres", pgDSN)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	src := pg2sqlite.NewPostgresSource(snapshotDB)
+	defer src.Close()
+
+	before := plannedNotes(t, src)
+	note3 := pg2sqlite.PgNote{
+		PgModel:  pg2sqlite.PgModel{CreatedAt: now, UpdatedAt: now},
+		UserID:   user1.ID,
+		BookUUID: book1.UUID,
+		Body:     "Written during the migration",
+		AddedOn:  now.Unix(),
+		EditedOn: now.Unix(),
+		USN:      3,
+		Client:   "cli",
+	}
+	if err := db.Create(&note3).Error; err != nil {
+		t.Fatalf("Failed to create note3: %v", err)
+	}
+	// The rollback moved the sequence past the ids it copied
+	if note3.ID != max(note1.ID, note2.ID)+1 {
+		t.Errorf("note3 ID: expected %d, got %d", max(note1.ID, note2.ID)+1, note3.ID)
+	}
+	if after := plannedNotes(t, src); after != before {
+		t.Errorf("notes: expected the snapshot to keep %d rows, got %d", before, after)
+	}
+
+	freshDB, err := sql.Open("postgres", pgDSN)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	fresh := pg2sqlite.NewPostgresSource(freshDB)
+	defer fresh.Close()
+	if n := plannedNotes(t, fresh); n != before+1 {
+		t.Errorf("notes: expected a new source to see %d rows, got %d", before+1, n)
+	}
+
 	// Clean up
 	os.Remove(sqlitePath)
 }
 
+// plannedNotes returns the number of notes a migration from src would copy.
+func plannedNotes(t *testing.T, src pg2sqlite.Source) int {
+	t.Helper()
+
+	plan, err := pg2sqlite.New(src, nil, pg2sqlite.Options{}).Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	for _, pt := range plan.Tables {
+		if pt.Name == "notes" {
+			return pt.Rows
+		}
+	}
+	t.Fatal("Plan has no notes table")
+	return 0
+}
+
 func getEnvOrDefault(key, defaultVal string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// partialPath is where the database for path is built before it is moved
+// into place.
+func partialPath(path string) string {
+	return path + ".partial"
+}
+
+// removeSQLite removes a SQLite database along with any journal files.
+func removeSQLite(path string) error {
+	for _, p := range []string{path, path + "-journal", path + "-wal", path + "-shm"} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copySQLite writes a consistent copy of the SQLite database at src to dst,
+// including changes still in its WAL. It fails if src is in use, as writes
+// made after the copy would be lost when dst replaces it. src itself is left
+// as it is, journal mode included, since it stays the operator's database
+// until the merge has succeeded. It returns the journal mode of src, which
+// the merged database is given back before it replaces src.
+func copySQLite(ctx context.Context, src, dst string) (string, error) {
+	// In exclusive locking mode the connection keeps the lock its first
+	// transaction takes, which it only gets while no other connection has
+	// src open, so this is where a running server gets in the way
+	db, err := sql.Open("sqlite3", "file:"+src+"?mode=rw&_locking_mode=EXCLUSIVE&_txlock=exclusive")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "SELECT COUNT(*) FROM sqlite_master")
+		tx.Rollback()
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w - is the Dnote server still running? Stop it before merging", err)
+	}
+
+	var journalMode string
+	if err := db.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return "", fmt.Errorf("reading the journal mode: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", dst); err != nil {
+		return "", err
+	}
+
+	return journalMode, db.Close()
+}
+
+// commitOutput flushes the finished database at partial to disk and renames
+// it to target, so that target never holds an incomplete database.
+func commitOutput(partial, target string) error {
+	f, err := os.OpenFile(partial, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing %s: %w", partial, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(partial, target); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(target))
+}
+
+// syncDir makes a rename in dir durable. Windows cannot sync directories and
+// does not need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", dir, err)
+	}
+
+	return nil
+}
+
+// exportFile appends to the file at path. It is only created on the first
+// write, so that a run with nothing to export leaves no file behind.
+type exportFile struct {
+	path string
+	f    *os.File
+}
+
+func (e *exportFile) Write(p []byte) (int, error) {
+	if e.f == nil {
+		// Append, so that resumed runs add to what earlier runs exported
+		f, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return 0, fmt.Errorf("opening encrypted export file: %w", err)
+		}
+		e.f = f
+	}
+
+	return e.f.Write(p)
+}
+
+func (e *exportFile) Close() error {
+	if e.f == nil {
+		return nil
+	}
+
+	return e.f.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokenTestDump has a note that cannot be converted, so the migration fails
+// after the other tables have been copied.
+var brokenTestDump = strings.Replace(testDump, "	t	2	f	f	cli\n", "	x	2	f	f	cli\n", 1)
+
+func TestFailedRunRemovesPartialOutput(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, brokenTestDump),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+	}
+
+	if err := run(context.Background(), config); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+
+	for _, path := range []string{config.SqlitePath, partialPath(config.SqlitePath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist, got %v", path, err)
+		}
+	}
+}
+
+func TestKeepFailedAndResume(t *testing.T) {
+	dumpPath := writeTestDump(t, brokenTestDump)
+	config := Config{
+		PgDumpFile: dumpPath,
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+		BatchSize:  1,
+		KeepFailed: true,
+	}
+
+	if err := run(context.Background(), config); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+	if _, err := os.Stat(config.SqlitePath); !os.IsNotExist(err) {
+		t.Errorf("expected no database at the target path, got %v", err)
+	}
+	if _, err := os.Stat(partialPath(config.SqlitePath)); err != nil {
+		t.Fatalf("expected partial output to be kept: %v", err)
+	}
+
+	// Without --resume the partial output blocks a new run
+	if err := os.WriteFile(dumpPath, []byte(testDump), 0644); err != nil {
+		t.Fatalf("Failed to fix dump: %v", err)
+	}
+	if err := run(context.Background(), config); err == nil || !strings.Contains(err.Error(), "--resume") {
+		t.Fatalf("expected an error suggesting --resume, got %v", err)
+	}
+
+	config.Resume = true
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Resumed migration failed: %v", err)
+	}
+	if _, err := os.Stat(partialPath(config.SqlitePath)); !os.IsNotExist(err) {
+		t.Errorf("expected partial output to be gone, got %v", err)
+	}
+	if n := countRows(t, config.SqlitePath, "notes"); n != 2 {
+		t.Errorf("notes: expected 2, got %d", n)
+	}
+	if n := countRows(t, config.SqlitePath, "users"); n != 2 {
+		t.Errorf("users: expected 2, got %d", n)
+	}
+}
+
+func TestStoppedRun(t *testing.T) {
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+	}
+
+	interrupted := errors.New("stopped by interrupt signal")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(interrupted)
+
+	err := run(ctx, config)
+	if !errors.Is(err, interrupted) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the run to stop with the signal as its cause, got %v", err)
+	}
+	for _, path := range []string{config.SqlitePath, partialPath(config.SqlitePath)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s not to exist, got %v", path, err)
+		}
+	}
+
+	config.Timeout = time.Nanosecond
+	if err := run(context.Background(), config); err == nil || !strings.Contains(err.Error(), "timed out after 1ns") {
+		t.Errorf("expected the run to time out, got %v", err)
+	}
+}
+
+func TestCopySQLite(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "server.db")
+	db, err := sql.Open("sqlite3", src)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("PRAGMA journal_mode=WAL; CREATE TABLE notes (body text); INSERT INTO notes VALUES ('in the WAL')"); err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+
+	// A server holding the database open keeps it from being copied
+	if _, err := copySQLite(context.Background(), src, filepath.Join(dir, "busy.db")); err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("Expected the open database to be refused, got %v", err)
+	}
+	db.Close()
+
+	dst := filepath.Join(dir, "copy.db")
+	journalMode, err := copySQLite(context.Background(), src, dst)
+	if err != nil {
+		t.Fatalf("copySQLite failed: %v", err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("Expected journal mode wal, got %q", journalMode)
+	}
+
+	check := func(path, query, expected string) {
+		t.Helper()
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", path, err)
+		}
+		defer db.Close()
+
+		var got string
+		if err := db.QueryRow(query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, got)
+		}
+	}
+	check(dst, "SELECT body FROM notes", "in the WAL")
+	check(src, "PRAGMA journal_mode", "wal")
+}
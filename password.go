@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// redacted replaces secrets in error messages.
+const redacted = "xxxxx"
+
+// readPasswordFlags sets the password from --pg-password-file or
+// --pg-password-stdin. At most one way of passing the password may be used.
+func readPasswordFlags(config *Config, stdin io.Reader) error {
+	given := 0
+	for _, set := range []bool{config.PgPassword != "", config.PgPasswordFile != "", config.PgPasswordStdin} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return fmt.Errorf("only one of --pg-password, --pg-password-file and --pg-password-stdin can be used")
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case config.PgPasswordFile != "":
+		data, err = os.ReadFile(config.PgPasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading password file: %w", err)
+		}
+	case config.PgPasswordStdin:
+		data, err = io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("reading password from stdin: %w", err)
+		}
+	default:
+		return nil
+	}
+
+	// Files and pipes usually end the password with a newline
+	config.PgPassword = strings.TrimRight(string(data), "\r\n")
+	if config.PgPassword == "" {
+		return fmt.Errorf("the password read is empty")
+	}
+
+	return nil
+}
+
+// promptPassword asks for the password on the terminal, without echoing it.
+// It does nothing unless stdin is a terminal, so scripts never block on it.
+func promptPassword(config *Config) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for PostgreSQL user %s on %s: ", config.PgUser, config.PgHost)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return fmt.Errorf("reading password: %w", err)
+	}
+
+	config.PgPassword = string(password)
+	return nil
+}
+
+// redactedError hides the connection secrets of a Config that may appear in
+// the message of an error from the driver.
+type redactedError struct {
+	err      error
+	replacer *strings.Replacer
+}
+
+func redactError(err error, config Config) error {
+	if err == nil {
+		return nil
+	}
+
+	var pairs []string
+	if config.PgPassword != "" {
+		safe := config
+		safe.PgPassword = redacted
+		pairs = append(pairs, postgresDSN(config), postgresDSN(safe))
+	}
+	if config.PgURL != "" {
+		if u, err := url.Parse(config.PgURL); err == nil {
+			pairs = append(pairs, config.PgURL, u.Redacted())
+		}
+	}
+	if config.PgPassword != "" {
+		pairs = append(pairs, config.PgPassword, redacted)
+	}
+	if len(pairs) == 0 {
+		return err
+	}
+
+	return &redactedError{err: err, replacer: strings.NewReplacer(pairs...)}
+}
+
+func (e *redactedError) Error() string {
+	return e.replacer.Replace(e.err.Error())
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
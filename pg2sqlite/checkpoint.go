@@ -0,0 +1,78 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// checkpointTable records, for every table, how far the migration got. It is
+// written in the same transaction as each batch of rows so that it never
+// disagrees with the data, and it is dropped once the migration completes.
+const checkpointTable = "pg2sqlite_checkpoints"
+
+type checkpoint struct {
+	LastID int
+	Rows   int
+	Done   bool
+}
+
+func initCheckpoints(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+checkpointTable+` (
+			table_name TEXT PRIMARY KEY,
+			last_id INTEGER NOT NULL,
+			rows INTEGER NOT NULL,
+			done BOOLEAN NOT NULL,
+			updated_at DATETIME NOT NULL
+		)
+	`)
+
+	return err
+}
+
+// HasCheckpoints reports whether db was left behind by an unfinished
+// migration and can therefore be resumed.
+func HasCheckpoints(ctx context.Context, db *sql.DB) (bool, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", checkpointTable).Scan(&count); err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func loadCheckpoint(ctx context.Context, db *sql.DB, table string) (checkpoint, error) {
+	var cp checkpoint
+
+	err := db.QueryRowContext(ctx, "SELECT last_id, rows, done FROM "+checkpointTable+" WHERE table_name = ?", table).
+		Scan(&cp.LastID, &cp.Rows, &cp.Done)
+	if err == sql.ErrNoRows {
+		return checkpoint{}, nil
+	}
+
+	return cp, err
+}
+
+func saveCheckpoint(ctx context.Context, tx *sql.Tx, table string, cp checkpoint) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO `+checkpointTable+` (table_name, last_id, rows, done, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (table_name) DO UPDATE SET
+			last_id = excluded.last_id,
+			rows = excluded.rows,
+			done = excluded.done,
+			updated_at = excluded.updated_at
+	`, table, cp.LastID, cp.Rows, cp.Done, time.Now())
+	if err != nil {
+		return fmt.Errorf("saving checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+func dropCheckpoints(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, "DROP TABLE "+checkpointTable)
+	return err
+}
@@ -0,0 +1,543 @@
+package pg2sqlite
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// customDumpMagic starts every pg_dump custom-format (-Fc) archive.
+const customDumpMagic = "PGDMP"
+
+// dumpVersionPrefix starts the header line in which pg_dump records the
+// version of the server it dumped.
+const dumpVersionPrefix = "-- Dumped from database version "
+
+// indexCheckInterval is how many lines are indexed between checks for
+// cancellation.
+const indexCheckInterval = 10000
+
+var copyHeaderRegexp = regexp.MustCompile(`^COPY\s+(\S+)\s+\((.*)\)\s+FROM\s+stdin;\s*$`)
+
+// dumpTimestampLayouts are the formats Postgres uses to print timestamp and
+// timestamptz values in COPY output.
+var dumpTimestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+// dumpSource reads the COPY blocks of a plain-format pg_dump file. It indexes
+// the position of every row on open, so rows can be served in id order
+// without holding the data in memory.
+type dumpSource struct {
+	f          *os.File
+	tables     map[string]*dumpTable
+	migrations []string
+	version    string
+}
+
+type dumpTable struct {
+	columns []string
+	entries []dumpEntry
+}
+
+// dumpEntry is the location of one COPY row in the dump file.
+type dumpEntry struct {
+	id     int
+	offset int64
+	length int
+}
+
+// OpenDumpSource indexes the plain-format pg_dump file at path and returns a
+// Source that reads from it. Indexing a large dump takes a while, so it stops
+// once ctx is done.
+func OpenDumpSource(ctx context.Context, path string) (Source, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &dumpSource{f: f, tables: map[string]*dumpTable{}}
+	if err := s.index(ctx); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *dumpSource) index(ctx context.Context) error {
+	r := bufio.NewReaderSize(s.f, 1<<20)
+
+	magic, err := r.Peek(len(customDumpMagic))
+	if err == nil && string(magic) == customDumpMagic {
+		return fmt.Errorf("custom-format pg_dump archives are not supported - convert it to a plain SQL file with 'pg_restore -f dump.sql %s' first", s.f.Name())
+	}
+
+	var offset int64
+	var lineNum int
+	var current *dumpTable
+	var currentName string
+	idIndex := -1
+	inMigrations := false
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+
+		lineNum++
+		if lineNum%indexCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		lineOffset := offset
+		offset += int64(len(line))
+		content := bytes.TrimRight(line, "\r\n")
+
+		if inMigrations {
+			if string(content) == `\.` {
+				inMigrations = false
+			} else {
+				id, _, err := decodeCopyValue(bytes.SplitN(content, []byte{'\t'}, 2)[0])
+				if err != nil {
+					return fmt.Errorf("line %d: %w", lineNum, err)
+				}
+				s.migrations = append(s.migrations, id)
+			}
+		} else if current == nil {
+			if v, ok := bytes.CutPrefix(content, []byte(dumpVersionPrefix)); ok && s.version == "" {
+				s.version = string(v)
+			}
+
+			name, columns, ok := parseCopyHeader(string(content))
+			if ok && name == migrationsTable && len(columns) > 0 && columns[0] == "id" {
+				inMigrations = true
+			} else if ok {
+				if _, exists := sourceColumns[name]; exists {
+					if _, dup := s.tables[name]; dup {
+						return fmt.Errorf("line %d: table %s appears twice in the dump", lineNum, name)
+					}
+
+					current = &dumpTable{columns: columns}
+					currentName = name
+					idIndex = slices.Index(columns, "id")
+					if idIndex == -1 {
+						return fmt.Errorf("line %d: COPY for %s has no id column", lineNum, name)
+					}
+				}
+			}
+		} else if string(content) == `\.` {
+			s.tables[currentName] = current
+			current = nil
+		} else {
+			field, err := copyField(content, idIndex)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			id, err := strconv.Atoi(field)
+			if err != nil {
+				return fmt.Errorf("line %d: parsing %s id %q: %w", lineNum, currentName, field, err)
+			}
+
+			current.entries = append(current.entries, dumpEntry{id: id, offset: lineOffset, length: len(content)})
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if current != nil {
+		return fmt.Errorf("dump ends inside the COPY block for %s", currentName)
+	}
+
+	for _, t := range s.tables {
+		sort.Slice(t.entries, func(i, j int) bool {
+			return t.entries[i].id < t.entries[j].id
+		})
+	}
+
+	return nil
+}
+
+func (s *dumpSource) rows(ctx context.Context, table string, columns []string, afterID int) (sourceRows, error) {
+	t, indexes, err := s.table(table, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].id > afterID
+	})
+
+	return &dumpRows{ctx: ctx, f: s.f, entries: t.entries[start:], indexes: indexes}, nil
+}
+
+// table returns the indexed table called name, and the position of each of
+// columns in its rows.
+func (s *dumpSource) table(name string, columns []string) (*dumpTable, []int, error) {
+	t, ok := s.tables[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("dump has no COPY data for table %s", name)
+	}
+
+	indexes := make([]int, len(columns))
+	for i, c := range columns {
+		indexes[i] = slices.Index(t.columns, c)
+		if indexes[i] == -1 {
+			return nil, nil, fmt.Errorf("column %s.%s not found in dump", name, c)
+		}
+	}
+
+	return t, indexes, nil
+}
+
+// changedRows reads the columns that select the rows of table first, and
+// then serves the selected ones.
+func (s *dumpSource) changedRows(ctx context.Context, table string, columns []string, c changes) (sourceRows, error) {
+	t, indexes, err := s.table(table, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	selectBy := []string{"updated_at"}
+	if cols, ok := usnColumns[table]; ok {
+		selectBy = append(selectBy, cols[0], cols[1])
+	}
+	_, selectIndexes, err := s.table(table, selectBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []dumpEntry
+	all := &dumpRows{ctx: ctx, f: s.f, entries: t.entries, indexes: selectIndexes}
+	for all.Next() {
+		var updatedAt time.Time
+		var userID, usn int
+		dest := []any{&updatedAt}
+		if len(selectBy) > 1 {
+			dest = append(dest, &userID, &usn)
+		}
+		if err := all.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		// Tables without USNs leave userID at 0, which is no user's
+		if c.changed(userID, usn, updatedAt) {
+			entries = append(entries, all.entries[all.pos-1])
+		}
+	}
+	if err := all.Err(); err != nil {
+		return nil, err
+	}
+
+	return &dumpRows{ctx: ctx, f: s.f, entries: entries, indexes: indexes}, nil
+}
+
+// now returns the zero time, as a dump does not record when it was taken.
+func (s *dumpSource) now(ctx context.Context) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (s *dumpSource) countRows(ctx context.Context, table string, afterID int) (int, error) {
+	t, ok := s.tables[table]
+	if !ok {
+		return 0, fmt.Errorf("dump has no COPY data for table %s", table)
+	}
+
+	start := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].id > afterID
+	})
+
+	return len(t.entries) - start, nil
+}
+
+func (s *dumpSource) tableColumns(ctx context.Context, table string) ([]string, error) {
+	if t, ok := s.tables[table]; ok {
+		return t.columns, nil
+	}
+
+	return nil, nil
+}
+
+// appliedMigrations returns the migrations in the order they were dumped,
+// which is the order they were inserted unless the table was rewritten.
+func (s *dumpSource) appliedMigrations(ctx context.Context) ([]string, error) {
+	return s.migrations, nil
+}
+
+func (s *dumpSource) serverVersion(ctx context.Context) (string, error) {
+	return s.version, nil
+}
+
+func (s *dumpSource) Close() error {
+	return s.f.Close()
+}
+
+// dumpRows iterates over indexed COPY rows, reading each line from the file
+// as it is reached. It stops with ctx's error once ctx is done.
+type dumpRows struct {
+	ctx     context.Context
+	f       *os.File
+	entries []dumpEntry
+	indexes []int
+
+	pos    int
+	values []*string
+	err    error
+}
+
+func (r *dumpRows) Next() bool {
+	if r.err != nil || r.pos >= len(r.entries) {
+		return false
+	}
+	if r.err = r.ctx.Err(); r.err != nil {
+		return false
+	}
+
+	e := r.entries[r.pos]
+	r.pos++
+
+	line := make([]byte, e.length)
+	if _, err := r.f.ReadAt(line, e.offset); err != nil {
+		r.err = fmt.Errorf("reading row %d: %w", e.id, err)
+		return false
+	}
+
+	fields := bytes.Split(line, []byte{'\t'})
+	r.values = make([]*string, len(r.indexes))
+	for i, idx := range r.indexes {
+		if idx >= len(fields) {
+			r.err = fmt.Errorf("row %d has %d fields", e.id, len(fields))
+			return false
+		}
+
+		v, isNull, err := decodeCopyValue(fields[idx])
+		if err != nil {
+			r.err = fmt.Errorf("row %d: %w", e.id, err)
+			return false
+		}
+		if !isNull {
+			r.values[i] = &v
+		}
+	}
+
+	return true
+}
+
+func (r *dumpRows) Scan(dest ...any) error {
+	if len(dest) != len(r.values) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(r.values), len(dest))
+	}
+
+	for i, d := range dest {
+		if err := scanCopyValue(r.values[i], d); err != nil {
+			return fmt.Errorf("converting column %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *dumpRows) Err() error {
+	return r.err
+}
+
+func (r *dumpRows) Close() error {
+	return nil
+}
+
+// parseCopyHeader parses a "COPY public.notes (id, ...) FROM stdin;" line and
+// returns the unqualified table name and its columns.
+func parseCopyHeader(line string) (string, []string, bool) {
+	m := copyHeaderRegexp.FindStringSubmatch(line)
+	if m == nil {
+		return "", nil, false
+	}
+
+	name := m[1]
+	if i := strings.LastIndex(name, "."); i != -1 {
+		name = name[i+1:]
+	}
+	name = strings.Trim(name, `"`)
+
+	var columns []string
+	for _, c := range strings.Split(m[2], ",") {
+		columns = append(columns, strings.Trim(strings.TrimSpace(c), `"`))
+	}
+
+	return name, columns, true
+}
+
+// copyField returns the raw text of the idx-th field of a COPY line.
+func copyField(line []byte, idx int) (string, error) {
+	fields := bytes.SplitN(line, []byte{'\t'}, idx+2)
+	if idx >= len(fields) {
+		return "", fmt.Errorf("row has %d fields", len(fields))
+	}
+
+	return string(fields[idx]), nil
+}
+
+// decodeCopyValue decodes a field of COPY text format, reporting whether it
+// is NULL.
+func decodeCopyValue(field []byte) (string, bool, error) {
+	if string(field) == `\N` {
+		return "", true, nil
+	}
+	if bytes.IndexByte(field, '\\') == -1 {
+		return string(field), false, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(field) {
+			return "", false, fmt.Errorf("trailing backslash in %q", field)
+		}
+
+		switch c = field[i]; {
+		case c == 'b':
+			b.WriteByte('\b')
+		case c == 'f':
+			b.WriteByte('\f')
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 'r':
+			b.WriteByte('\r')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'v':
+			b.WriteByte('\v')
+		case c >= '0' && c <= '7':
+			n := 0
+			j := i
+			for ; j < len(field) && j < i+3 && field[j] >= '0' && field[j] <= '7'; j++ {
+				n = n*8 + int(field[j]-'0')
+			}
+			b.WriteByte(byte(n))
+			i = j - 1
+		case c == 'x' && i+1 < len(field) && isHexDigit(field[i+1]):
+			j := i + 1
+			for ; j < len(field) && j < i+3 && isHexDigit(field[j]); j++ {
+			}
+			n, _ := strconv.ParseUint(string(field[i+1:j]), 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String(), false, nil
+}
+
+// scanCopyValue converts a decoded COPY value into one of the destination
+// types used by the migrate functions.
+func scanCopyValue(v *string, dest any) error {
+	switch d := dest.(type) {
+	case *any:
+		if v == nil {
+			*d = nil
+		} else {
+			*d = *v
+		}
+		return nil
+	case *sql.NullString:
+		if v == nil {
+			*d = sql.NullString{}
+			return nil
+		}
+		*d = sql.NullString{String: *v, Valid: true}
+		return nil
+	case *sql.NullTime:
+		if v == nil {
+			*d = sql.NullTime{}
+			return nil
+		}
+		t, err := parseDumpTimestamp(*v)
+		if err != nil {
+			return err
+		}
+		*d = sql.NullTime{Time: t, Valid: true}
+		return nil
+	}
+
+	if v == nil {
+		return fmt.Errorf("unexpected NULL")
+	}
+
+	switch d := dest.(type) {
+	case *string:
+		*d = *v
+	case *int:
+		n, err := strconv.Atoi(*v)
+		if err != nil {
+			return err
+		}
+		*d = n
+	case *int64:
+		n, err := strconv.ParseInt(*v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*d = n
+	case *bool:
+		switch *v {
+		case "t":
+			*d = true
+		case "f":
+			*d = false
+		default:
+			return fmt.Errorf("invalid boolean %q", *v)
+		}
+	case *time.Time:
+		t, err := parseDumpTimestamp(*v)
+		if err != nil {
+			return err
+		}
+		*d = t
+	default:
+		return fmt.Errorf("unsupported destination type %T", dest)
+	}
+
+	return nil
+}
+
+func parseDumpTimestamp(s string) (time.Time, error) {
+	for _, layout := range dumpTimestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,156 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// testDump is an excerpt of a plain-format pg_dump of a Dnote v2 database.
+// Rows are deliberately out of id order, as pg_dump does not sort them.
+var testDump = func() string {
+	b, err := os.ReadFile(filepath.Join("testdata", "v2.sql"))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}()
+
+func writeTestDump(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dump.sql")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write dump: %v", err)
+	}
+
+	return path
+}
+
+func TestDecodeCopyValue(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+		isNull   bool
+	}{
+		{input: `plain`, expected: "plain"},
+		{input: `\N`, isNull: true},
+		{input: `a\tb\nc\\d`, expected: "a\tb\nc\\d"},
+		{input: `\r\b\f\v`, expected: "\r\b\f\v"},
+		{input: `\101\x42\7`, expected: "AB\a"},
+		{input: `\\N`, expected: `\N`},
+		{input: `\q`, expected: "q"},
+	}
+
+	for _, tc := range testCases {
+		got, isNull, err := decodeCopyValue([]byte(tc.input))
+		if err != nil {
+			t.Errorf("decodeCopyValue(%q): unexpected error: %v", tc.input, err)
+			continue
+		}
+		if isNull != tc.isNull {
+			t.Errorf("decodeCopyValue(%q): expected isNull %v, got %v", tc.input, tc.isNull, isNull)
+		}
+		if got != tc.expected {
+			t.Errorf("decodeCopyValue(%q): expected %q, got %q", tc.input, tc.expected, got)
+		}
+	}
+}
+
+func TestParseCopyHeader(t *testing.T) {
+	name, columns, ok := parseCopyHeader(`COPY public."notes" (id, "user", body) FROM stdin;`)
+	if !ok {
+		t.Fatal("expected header to parse")
+	}
+	if name != "notes" {
+		t.Errorf("name: expected notes, got %s", name)
+	}
+	if len(columns) != 3 || columns[0] != "id" || columns[1] != "user" || columns[2] != "body" {
+		t.Errorf("columns: expected [id user body], got %v", columns)
+	}
+
+	if _, _, ok := parseCopyHeader(`SET client_encoding = 'UTF8';`); ok {
+		t.Error("expected SET statement not to parse as a COPY header")
+	}
+}
+
+func TestDumpSourceRows(t *testing.T) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, testDump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	rows, err := src.rows(context.Background(), "users", []string{"id", "last_login_at", "cloud"}, 0)
+	if err != nil {
+		t.Fatalf("Failed to read users: %v", err)
+	}
+
+	var ids []int
+	var lastLogins []sql.NullTime
+	for rows.Next() {
+		var id int
+		var lastLoginAt sql.NullTime
+		var cloud bool
+		if err := rows.Scan(&id, &lastLoginAt, &cloud); err != nil {
+			t.Fatalf("Failed to scan user: %v", err)
+		}
+		ids = append(ids, id)
+		lastLogins = append(lastLogins, lastLoginAt)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Failed to iterate users: %v", err)
+	}
+
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Fatalf("ids: expected [1 2], got %v", ids)
+	}
+	expectedLogin := time.Date(2024, 1, 31, 15, 0, 0, 0, time.UTC)
+	if !lastLogins[0].Valid || !lastLogins[0].Time.Equal(expectedLogin) {
+		t.Errorf("user 1 last_login_at: expected %v, got %v", expectedLogin, lastLogins[0])
+	}
+	if lastLogins[1].Valid {
+		t.Errorf("user 2 last_login_at: expected NULL, got %v", lastLogins[1].Time)
+	}
+
+	// Pagination picks up after the given id
+	rows, err = src.rows(context.Background(), "users", []string{"id"}, 1)
+	if err != nil {
+		t.Fatalf("Failed to read users: %v", err)
+	}
+	var count int
+	for rows.Next() {
+		count++
+	}
+	if count != 1 {
+		t.Errorf("rows after id 1: expected 1, got %d", count)
+	}
+
+	if _, err := src.rows(context.Background(), "users", []string{"missing"}, 0); err == nil {
+		t.Error("expected an error for a column missing from the dump")
+	}
+
+	// Reading stops once the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	rows, err = src.rows(ctx, "users", []string{"id"}, 0)
+	if err != nil {
+		t.Fatalf("Failed to read users: %v", err)
+	}
+	cancel()
+	if rows.Next() {
+		t.Error("expected no rows after cancellation")
+	}
+	if !errors.Is(rows.Err(), context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", rows.Err())
+	}
+}
+
+func TestDumpSourceCustomFormat(t *testing.T) {
+	if _, err := OpenDumpSource(context.Background(), writeTestDump(t, "PGDMP\x01\x0e\x00")); err == nil {
+		t.Error("expected custom-format archives to be rejected")
+	}
+}
@@ -0,0 +1,127 @@
+package pg2sqlite
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EncryptedPolicy decides what happens to books and notes that legacy Dnote
+// clients encrypted. Dnote v3 has no notion of encryption, so these rows would
+// otherwise turn into books and notes whose label or body is ciphertext.
+type EncryptedPolicy string
+
+const (
+	EncryptedSkip EncryptedPolicy = "skip"
+	EncryptedKeep EncryptedPolicy = "keep"
+	EncryptedFail EncryptedPolicy = "fail"
+)
+
+// ParseEncryptedPolicy parses the name of an EncryptedPolicy.
+func ParseEncryptedPolicy(s string) (EncryptedPolicy, error) {
+	switch p := EncryptedPolicy(s); p {
+	case EncryptedSkip, EncryptedKeep, EncryptedFail:
+		return p, nil
+	}
+
+	return "", fmt.Errorf("invalid encrypted policy %q: must be skip, keep or fail", s)
+}
+
+// Outcome describes what the policy did to encrypted rows, for a summary.
+func (p EncryptedPolicy) Outcome() string {
+	if p == EncryptedSkip {
+		return "skipped"
+	}
+
+	return "migrated as-is"
+}
+
+// EncryptedRecord is a skipped encrypted book or note, as written to
+// Options.EncryptedExport.
+type EncryptedRecord struct {
+	Table     string    `json:"table"`
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UUID      string    `json:"uuid"`
+	UserID    int       `json:"user_id"`
+	Label     string    `json:"label,omitempty"`
+	BookUUID  string    `json:"book_uuid,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	AddedOn   int64     `json:"added_on"`
+	EditedOn  int64     `json:"edited_on"`
+	Public    bool      `json:"public,omitempty"`
+	USN       int       `json:"usn"`
+	Deleted   bool      `json:"deleted"`
+	Client    string    `json:"client,omitempty"`
+}
+
+func (m *Migrator) exportEncrypted(r EncryptedRecord) error {
+	if m.export == nil {
+		return nil
+	}
+
+	if err := m.export.Encode(r); err != nil {
+		return fmt.Errorf("exporting encrypted %s %d: %w", r.Table, r.ID, err)
+	}
+
+	return nil
+}
+
+// countEncrypted counts the encrypted rows of table that sel selects.
+func countEncrypted(ctx context.Context, src Source, table string, sel *selection) (int, error) {
+	if !sel.table(table) {
+		return 0, nil
+	}
+
+	rows, err := src.rows(ctx, table, []string{"user_id", "encrypted"}, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var userID int
+		var encrypted bool
+		if err := rows.Scan(&userID, &encrypted); err != nil {
+			return 0, err
+		}
+		if encrypted && sel.user(userID) {
+			count++
+		}
+	}
+
+	return count, rows.Err()
+}
+
+// checkEncrypted counts the encrypted books and notes in the source, and
+// fails if there are any and the policy does not say what to do with them.
+func (m *Migrator) checkEncrypted(ctx context.Context) error {
+	var err error
+	if m.stats.EncryptedBooks, err = countEncrypted(ctx, m.src, "books", m.sel); err != nil {
+		return fmt.Errorf("counting encrypted books: %w", err)
+	}
+	if m.stats.EncryptedNotes, err = countEncrypted(ctx, m.src, "notes", m.sel); err != nil {
+		return fmt.Errorf("counting encrypted notes: %w", err)
+	}
+
+	books, notes := m.stats.EncryptedBooks, m.stats.EncryptedNotes
+	if books == 0 && notes == 0 {
+		return nil
+	}
+
+	switch m.encrypted {
+	case EncryptedFail:
+		return fmt.Errorf("found %d encrypted books and %d encrypted notes, which Dnote v3 cannot decrypt. Pass --encrypted=skip to leave them out (with --encrypted-export to save a copy) or --encrypted=keep to migrate the ciphertext as-is", books, notes)
+	case EncryptedSkip:
+		m.logf("Skipping %d encrypted books and %d encrypted notes", books, notes)
+		if m.export == nil {
+			m.warnf("the skipped encrypted books and notes are not exported anywhere")
+		}
+	case EncryptedKeep:
+		m.warnf("migrating %d encrypted books and %d encrypted notes as-is; their labels and bodies will be ciphertext", books, notes)
+	}
+
+	return nil
+}
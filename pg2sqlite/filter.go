@@ -0,0 +1,166 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Filter selects the part of the source to migrate, such as the data of one
+// tenant of a shared server. The zero value migrates everything.
+type Filter struct {
+	// UserUUIDs and UserEmails select users by uuid and by the email of
+	// their account. If either is set, only the selected users and their
+	// rows are migrated.
+	UserUUIDs  []string
+	UserEmails []string
+	// Tables lists the tables to migrate, or every table if empty
+	Tables []string
+	// SkipTables lists tables to leave out
+	SkipTables []string
+}
+
+// tableParents lists the tables that the rows of each table reference, and
+// which therefore have to be migrated along with it.
+var tableParents = map[string][]string{
+	"accounts": {"users"},
+	"books":    {"users"},
+	"notes":    {"users", "books"},
+	"tokens":   {"users"},
+	"sessions": {"users"},
+}
+
+// Validate checks that the filter names known tables and that every
+// selected table is selected together with the tables it references.
+func (f Filter) Validate() error {
+	_, err := f.tables()
+	return err
+}
+
+// tables returns the set of tables the filter selects.
+func (f Filter) tables() (map[string]bool, error) {
+	for _, t := range slices.Concat(f.Tables, f.SkipTables) {
+		if !slices.Contains(tableOrder, t) {
+			return nil, fmt.Errorf("unknown table %q: must be one of %s", t, strings.Join(tableOrder, ", "))
+		}
+	}
+
+	selected := map[string]bool{}
+	for _, t := range tableOrder {
+		if (len(f.Tables) == 0 || slices.Contains(f.Tables, t)) && !slices.Contains(f.SkipTables, t) {
+			selected[t] = true
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no tables selected")
+	}
+
+	for _, t := range tableOrder {
+		for _, parent := range tableParents[t] {
+			if selected[t] && !selected[parent] {
+				return nil, fmt.Errorf("%s cannot be migrated without %s, which its rows reference", t, parent)
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// selection is a Filter resolved against the source. A nil selection
+// selects everything.
+type selection struct {
+	tables map[string]bool
+	// users holds the ids of the selected users, or is nil if every user is
+	// selected
+	users map[int]bool
+}
+
+// table reports whether the table called name is migrated.
+func (s *selection) table(name string) bool {
+	return s == nil || s.tables[name]
+}
+
+// user reports whether the rows of the user with id are migrated.
+func (s *selection) user(id int) bool {
+	return s == nil || s.users == nil || s.users[id]
+}
+
+// resolveFilter looks up the users selected by f in src. Every uuid and
+// email has to match a user, so that a typo cannot quietly produce an empty
+// database.
+func resolveFilter(ctx context.Context, src Source, f Filter) (*selection, error) {
+	tables, err := f.tables()
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &selection{tables: tables}
+	if len(f.UserUUIDs) == 0 && len(f.UserEmails) == 0 {
+		return sel, nil
+	}
+	sel.users = map[int]bool{}
+
+	uuids := map[string]bool{}
+	for _, uuid := range f.UserUUIDs {
+		uuids[strings.ToLower(uuid)] = false
+	}
+	if len(uuids) > 0 {
+		err := scanSource(ctx, src, "users", []string{"id", "uuid"}, func(scan func(...any) error) error {
+			var id int
+			var uuid string
+			if err := scan(&id, &uuid); err != nil {
+				return err
+			}
+			if _, ok := uuids[strings.ToLower(uuid)]; ok {
+				uuids[strings.ToLower(uuid)] = true
+				sel.users[id] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading users: %w", err)
+		}
+	}
+
+	// Email addresses are compared the way people type them, ignoring case
+	emails := map[string]bool{}
+	for _, email := range f.UserEmails {
+		emails[strings.ToLower(email)] = false
+	}
+	if len(emails) > 0 {
+		err := scanSource(ctx, src, "accounts", []string{"user_id", "email"}, func(scan func(...any) error) error {
+			var userID int
+			var email sql.NullString
+			if err := scan(&userID, &email); err != nil {
+				return err
+			}
+			if _, ok := emails[strings.ToLower(email.String)]; ok && email.Valid {
+				emails[strings.ToLower(email.String)] = true
+				sel.users[userID] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading accounts: %w", err)
+		}
+	}
+
+	var missing []string
+	for _, uuid := range f.UserUUIDs {
+		if !uuids[strings.ToLower(uuid)] {
+			missing = append(missing, "uuid "+uuid)
+		}
+	}
+	for _, email := range f.UserEmails {
+		if !emails[strings.ToLower(email)] {
+			missing = append(missing, "email "+email)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no user found with %s", strings.Join(missing, ", "))
+	}
+
+	return sel, nil
+}
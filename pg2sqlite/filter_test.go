@@ -0,0 +1,109 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterValidate(t *testing.T) {
+	testCases := []struct {
+		filter Filter
+		err    string
+	}{
+		{filter: Filter{}},
+		{filter: Filter{SkipTables: []string{"sessions", "tokens"}}},
+		{filter: Filter{Tables: []string{"users", "accounts"}}},
+		{filter: Filter{Tables: []string{"users", "notes"}}, err: "notes cannot be migrated without books"},
+		{filter: Filter{SkipTables: []string{"users"}}, err: "accounts cannot be migrated without users"},
+		{filter: Filter{Tables: []string{"users"}, SkipTables: []string{"users"}}, err: "no tables selected"},
+		{filter: Filter{Tables: []string{"user"}}, err: `unknown table "user"`},
+	}
+
+	for _, tc := range testCases {
+		err := tc.filter.Validate()
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc.filter, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error containing %q, got %v", tc.filter, tc.err, err)
+		}
+	}
+}
+
+func runFilteredMigration(t *testing.T, dump string, opts Options) (*sql.DB, *Result, error) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, dump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	result, err := New(src, db, opts).Run(context.Background())
+	return db, result, err
+}
+
+func TestFilterUsers(t *testing.T) {
+	_, result, err := runFilteredMigration(t, testDump, Options{Filter: Filter{
+		UserEmails: []string{"USER1@example.com"},
+		SkipTables: []string{"sessions"},
+	}})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := MigrationStats{Users: 1, Accounts: 1, Books: 1, Notes: 2, Tokens: 1, UnverifiedAccounts: 1}
+	if result.Stats != expected {
+		t.Errorf("Stats: expected %+v, got %+v", expected, result.Stats)
+	}
+
+	var tables []string
+	for _, ts := range result.Tables {
+		tables = append(tables, ts.Name)
+		if ts.Name == "users" && (ts.Read != 2 || ts.Filtered != 1 || ts.Skipped != 0) {
+			t.Errorf("users: expected 2 read, 1 filtered and none skipped, got %+v", ts)
+		}
+	}
+	if strings.Join(tables, ",") != "users,accounts,books,tokens,notes" {
+		t.Errorf("Expected sessions to be left out, got tables %v", tables)
+	}
+
+	// The other user has no rows but its own
+	_, result, err = runFilteredMigration(t, testDump, Options{Filter: Filter{
+		UserUUIDs: []string{"0B4A4D7E-0E5C-4F7E-9A2B-6C1D2E3F4A5B"},
+	}})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	expected = MigrationStats{Users: 1, Accounts: 1}
+	if result.Stats != expected {
+		t.Errorf("Stats: expected %+v, got %+v", expected, result.Stats)
+	}
+
+	_, _, err = runFilteredMigration(t, testDump, Options{Filter: Filter{
+		UserUUIDs:  []string{"00000000-0000-4000-8000-000000000000"},
+		UserEmails: []string{"nobody@example.com"},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "no user found with uuid 00000000-0000-4000-8000-000000000000, email nobody@example.com") {
+		t.Errorf("Expected unknown users to be reported, got %v", err)
+	}
+}
+
+func TestFilterIgnoresOtherUsersOrphans(t *testing.T) {
+	_, _, err := runFilteredMigration(t, orphanDump(), Options{Filter: Filter{
+		UserEmails: []string{"user1@example.com"},
+	}})
+
+	// Only the notes of user 1 whose book is missing are left, as the rows
+	// of the missing user 9 are filtered out
+	if err == nil || !strings.Contains(err.Error(), "found 2 rows that reference a missing user or book (2 notes without a book)") {
+		t.Errorf("Expected only user 1's orphans to be reported, got %v", err)
+	}
+}
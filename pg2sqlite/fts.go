@@ -0,0 +1,27 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// checkFTSIndex makes sure every migrated note made it into the full-text
+// index. notes_fts is an external content table, so its rows are counted
+// through the docsize shadow table rather than the virtual table itself,
+// which would read straight from notes.
+func checkFTSIndex(ctx context.Context, tx *sql.Tx) error {
+	var noteCount, indexCount int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM notes").Scan(&noteCount); err != nil {
+		return fmt.Errorf("counting notes: %w", err)
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM notes_fts_docsize").Scan(&indexCount); err != nil {
+		return fmt.Errorf("counting indexed notes: %w", err)
+	}
+
+	if noteCount != indexCount {
+		return fmt.Errorf("full-text index has %d rows but notes has %d", indexCount, noteCount)
+	}
+
+	return nil
+}
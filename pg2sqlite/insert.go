@@ -0,0 +1,128 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// insertRowsPerStatement is the number of rows written by each multi-row
+// INSERT. It keeps the number of bound variables well under SQLite's limit
+// for the widest table.
+const insertRowsPerStatement = 200
+
+// SQLiteLoadParams are connection parameters that tune a target database for
+// bulk loading and enforce foreign keys on every connection. WAL with
+// synchronous=NORMAL still survives the process being killed, which resuming
+// relies on.
+const SQLiteLoadParams = "_journal_mode=WAL&_synchronous=NORMAL&_cache_size=-262144&_foreign_keys=on"
+
+// batchInserter writes rows to a table with multi-row INSERT statements,
+// buffering rows until a statement is full.
+type batchInserter struct {
+	ctx         context.Context
+	tx          *sql.Tx
+	table       string
+	columns     []string
+	rowsPerStmt int
+	// upsert overwrites rows that already exist with the same id
+	upsert bool
+
+	stmt    *sql.Stmt
+	pending []any
+	n       int
+}
+
+func newBatchInserter(ctx context.Context, tx *sql.Tx, table string, columns []string, rowsPerStmt int) *batchInserter {
+	return &batchInserter{
+		ctx:         ctx,
+		tx:          tx,
+		table:       table,
+		columns:     columns,
+		rowsPerStmt: rowsPerStmt,
+		pending:     make([]any, 0, rowsPerStmt*len(columns)),
+	}
+}
+
+// add buffers a row, writing the buffer out once it holds a full statement.
+func (b *batchInserter) add(values ...any) error {
+	if len(values) != len(b.columns) {
+		return fmt.Errorf("inserting into %s: expected %d values, got %d", b.table, len(b.columns), len(values))
+	}
+
+	b.pending = append(b.pending, values...)
+	b.n++
+
+	if b.n < b.rowsPerStmt {
+		return nil
+	}
+
+	// Full statements all have the same shape, so one is prepared and reused
+	if b.stmt == nil {
+		stmt, err := b.tx.PrepareContext(b.ctx, b.insertSQL(b.rowsPerStmt))
+		if err != nil {
+			return err
+		}
+		b.stmt = stmt
+	}
+
+	if _, err := b.stmt.ExecContext(b.ctx, b.pending...); err != nil {
+		return err
+	}
+	b.reset()
+
+	return nil
+}
+
+// flush writes any buffered rows.
+func (b *batchInserter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+
+	if _, err := b.tx.ExecContext(b.ctx, b.insertSQL(b.n), b.pending...); err != nil {
+		return err
+	}
+	b.reset()
+
+	return nil
+}
+
+func (b *batchInserter) close() error {
+	if b.stmt == nil {
+		return nil
+	}
+
+	return b.stmt.Close()
+}
+
+func (b *batchInserter) reset() {
+	b.pending = b.pending[:0]
+	b.n = 0
+}
+
+func (b *batchInserter) insertSQL(rows int) string {
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(b.columns)), ", ") + ")"
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "INSERT INTO %s (%s) VALUES ", b.table, strings.Join(b.columns, ", "))
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(placeholders)
+	}
+
+	if b.upsert {
+		var sets []string
+		for _, c := range b.columns {
+			if c != "id" {
+				sets = append(sets, fmt.Sprintf("%s = excluded.%s", c, c))
+			}
+		}
+		fmt.Fprintf(&sb, " ON CONFLICT (id) DO UPDATE SET %s", strings.Join(sets, ", "))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,131 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var benchNoteColumns = []string{"id", "created_at", "updated_at", "uuid", "user_id", "book_uuid", "body", "added_on", "edited_on", "public", "usn", "deleted", "client"}
+
+func insertTestNotes(tx *sql.Tx, firstID, n, rowsPerStmt int) error {
+	ins := newBatchInserter(context.Background(), tx, "notes", benchNoteColumns, rowsPerStmt)
+	defer ins.close()
+
+	now := time.Now()
+	for id := firstID; id < firstID+n; id++ {
+		body := fmt.Sprintf("note %d about golang, sqlite and full-text search", id)
+		if err := ins.add(id, now, now, fmt.Sprintf("uuid-%d", id), 1, "book-uuid", body, now.Unix(), now.Unix(), false, id, false, "cli"); err != nil {
+			return err
+		}
+	}
+
+	return ins.flush()
+}
+
+// insertTestParents adds the user and book that insertTestNotes refers to,
+// for databases that enforce foreign keys.
+func insertTestParents(db *sql.DB) error {
+	if _, err := db.Exec("INSERT INTO users (id, created_at, updated_at, uuid, max_usn) VALUES (1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'user-uuid', 0)"); err != nil {
+		return err
+	}
+	_, err := db.Exec(`INSERT INTO books (id, created_at, updated_at, uuid, user_id, label, added_on, edited_on, usn, deleted)
+		VALUES (1, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'book-uuid', 1, 'golang', 0, 0, 1, false)`)
+
+	return err
+}
+
+func TestBatchInserter(t *testing.T) {
+	db := openTestSQLite(t, "insert.db")
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Two full statements and a partial one
+	if err := insertTestNotes(tx, 1, 5, 2); err != nil {
+		t.Fatalf("Failed to insert notes: %v", err)
+	}
+
+	var count, maxID int
+	if err := tx.QueryRow("SELECT COUNT(*), MAX(id) FROM notes").Scan(&count, &maxID); err != nil {
+		t.Fatalf("Failed to count notes: %v", err)
+	}
+	if count != 5 || maxID != 5 {
+		t.Errorf("expected 5 notes up to id 5, got %d up to %d", count, maxID)
+	}
+
+	var body string
+	if err := tx.QueryRow("SELECT body FROM notes WHERE id = 3").Scan(&body); err != nil {
+		t.Fatalf("Failed to query note 3: %v", err)
+	}
+	if body != "note 3 about golang, sqlite and full-text search" {
+		t.Errorf("note 3 body: got %q", body)
+	}
+
+	ins := newBatchInserter(context.Background(), tx, "notes", benchNoteColumns, 2)
+	if err := ins.add(1, 2); err == nil {
+		t.Error("expected an error for the wrong number of values")
+	}
+}
+
+// BenchmarkInsertNotes compares writing notes one INSERT per row with SQLite
+// defaults, as the migration used to, against multi-row INSERTs with the
+// bulk loading pragmas.
+func BenchmarkInsertNotes(b *testing.B) {
+	const notes = 10000
+
+	benchmarks := []struct {
+		name        string
+		params      string
+		rowsPerStmt int
+	}{
+		{name: "row-by-row", params: "", rowsPerStmt: 1},
+		{name: "batched", params: SQLiteLoadParams, rowsPerStmt: insertRowsPerStatement},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				path := filepath.Join(b.TempDir(), fmt.Sprintf("bench-%d.db", i))
+				db, err := sql.Open("sqlite3", path+"?"+bm.params)
+				if err != nil {
+					b.Fatalf("Failed to open SQLite: %v", err)
+				}
+				db.SetMaxOpenConns(1)
+				if err := initSchema(context.Background(), db); err != nil {
+					b.Fatalf("Failed to create schema: %v", err)
+				}
+				if err := insertTestParents(db); err != nil {
+					b.Fatalf("Failed to insert user and book: %v", err)
+				}
+				b.StartTimer()
+
+				for first := 1; first <= notes; first += DefaultBatchSize {
+					tx, err := db.Begin()
+					if err != nil {
+						b.Fatalf("Failed to begin: %v", err)
+					}
+					if err := insertTestNotes(tx, first, DefaultBatchSize, bm.rowsPerStmt); err != nil {
+						b.Fatalf("Failed to insert notes: %v", err)
+					}
+					if err := tx.Commit(); err != nil {
+						b.Fatalf("Failed to commit: %v", err)
+					}
+				}
+
+				b.StopTimer()
+				db.Close()
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(notes*b.N)/b.Elapsed().Seconds(), "notes/s")
+		})
+	}
+}
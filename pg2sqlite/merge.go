@@ -0,0 +1,361 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// MergeReport lists how the source was fitted around the rows already in
+// the target by a merge.
+type MergeReport struct {
+	// Users are the source users folded into the target user with the same
+	// account email
+	Users []MergedUser
+	// IDs are the source rows given a new id because theirs was taken
+	IDs []RemappedID
+	// Books are the source books renamed because their user already had a
+	// book with that label
+	Books []RenamedBook
+	// USNs are the users whose source USNs were moved above the max_usn
+	// they had in the target
+	USNs []RebasedUSN
+}
+
+// MergedUser is a source user that already had an account in the target.
+type MergedUser struct {
+	Email    string
+	SourceID int
+	TargetID int
+}
+
+// RemappedID is a source row that was written with a different id.
+type RemappedID struct {
+	Table string
+	From  int
+	To    int
+}
+
+// RenamedBook is a source book that was written with a different label.
+type RenamedBook struct {
+	UUID   string
+	UserID int // in the target
+	From   string
+	To     string
+}
+
+// RebasedUSN is a merged user whose source USNs were offset so that clients
+// sync the imported books and notes.
+type RebasedUSN struct {
+	UserID int // in the target
+	Offset int
+}
+
+// mergePlan fits the source around the rows of an existing target. Ids are
+// given out as rows are written, in id order, so the report only lists rows
+// that were actually imported.
+type mergePlan struct {
+	// taken holds the ids of every table of the target, and next the last
+	// id given out, which starts above the target's and the source's ids
+	taken map[string]map[int]bool
+	next  map[string]int
+
+	// users maps source user ids to target ones. Merged users are known up
+	// front; the others are added as they are written.
+	users  map[int]int
+	merged map[int]bool
+	// usnBase is added to the USNs of each source user
+	usnBase map[int]int
+	// labels holds the labels of the books of every target user
+	labels map[int]map[string]bool
+	report MergeReport
+}
+
+// id returns the id to write the source row of table with id under.
+func (p *mergePlan) id(table string, id int) int {
+	if p == nil || !p.taken[table][id] {
+		return id
+	}
+
+	p.next[table]++
+	p.report.IDs = append(p.report.IDs, RemappedID{Table: table, From: id, To: p.next[table]})
+	return p.next[table]
+}
+
+// user returns the target id of the source user with id.
+func (p *mergePlan) user(id int) int {
+	if p == nil {
+		return id
+	}
+
+	return p.users[id]
+}
+
+// usn moves a USN of the source user with id above the user's USNs in the
+// target.
+func (p *mergePlan) usn(userID, usn int) int {
+	if p == nil {
+		return usn
+	}
+
+	return p.usnBase[userID] + usn
+}
+
+// label returns the label to write a book under, renaming it if the target
+// user already has a book with label. Deleted books keep theirs, as clients
+// do not show them.
+func (p *mergePlan) label(userID int, uuid, label string, deleted bool) string {
+	if p == nil || deleted {
+		return label
+	}
+
+	taken := p.labels[userID]
+	if taken == nil {
+		taken = map[string]bool{}
+		p.labels[userID] = taken
+	}
+
+	renamed := uniqueLabel(label, taken)
+	if renamed != label {
+		p.report.Books = append(p.report.Books, RenamedBook{UUID: uuid, UserID: userID, From: label, To: renamed})
+	}
+	taken[renamed] = true
+
+	return renamed
+}
+
+// uniqueLabel returns label, or label followed by the first free number if
+// it is taken.
+func uniqueLabel(label string, taken map[string]bool) string {
+	renamed := label
+	for n := 2; taken[renamed]; n++ {
+		renamed = fmt.Sprintf("%s (%d)", label, n)
+	}
+
+	return renamed
+}
+
+// checkMergeTarget makes sure the target already holds a Dnote v3 database
+// to merge into.
+func (m *Migrator) checkMergeTarget(ctx context.Context) error {
+	for _, table := range append(tableOrder, "notes_fts") {
+		columns, err := sqliteColumns(ctx, m.sqliteDB, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) == 0 {
+			return fmt.Errorf("target has no %s table - merging needs an existing Dnote v3 database", table)
+		}
+	}
+
+	return nil
+}
+
+// planMerge reads the target and the source to decide how they fit
+// together: which source users are already in the target, the ids to give
+// out, and the USNs and labels of the target's users.
+func (m *Migrator) planMerge(ctx context.Context) error {
+	p := &mergePlan{
+		taken:   map[string]map[int]bool{},
+		next:    map[string]int{},
+		users:   map[int]int{},
+		merged:  map[int]bool{},
+		usnBase: map[int]int{},
+		labels:  map[int]map[string]bool{},
+	}
+
+	for _, table := range tableOrder {
+		p.taken[table] = map[int]bool{}
+		err := queryTarget(ctx, m.sqliteDB, "SELECT id FROM "+table, func(scan func(...any) error) error {
+			var id int
+			if err := scan(&id); err != nil {
+				return err
+			}
+			p.taken[table][id] = true
+			p.next[table] = max(p.next[table], id)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading target %s: %w", table, err)
+		}
+
+		if !m.sel.table(table) {
+			continue
+		}
+		err = scanSource(ctx, m.src, table, []string{"id"}, func(scan func(...any) error) error {
+			var id int
+			if err := scan(&id); err != nil {
+				return err
+			}
+			p.next[table] = max(p.next[table], id)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", table, err)
+		}
+	}
+
+	// Recovered books take the ids after the source's books
+	if m.orphanPlan != nil {
+		for _, b := range m.orphanPlan.books {
+			p.next["books"] = max(p.next["books"], b.id)
+		}
+	}
+
+	maxUSN := map[int]int{}
+	err := queryTarget(ctx, m.sqliteDB, "SELECT id, max_usn FROM users", func(scan func(...any) error) error {
+		var id, usn int
+		if err := scan(&id, &usn); err != nil {
+			return err
+		}
+		maxUSN[id] = usn
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading target users: %w", err)
+	}
+
+	emails := map[string]int{}
+	err = queryTarget(ctx, m.sqliteDB, "SELECT user_id, email FROM accounts", func(scan func(...any) error) error {
+		var userID int
+		var email sql.NullString
+		if err := scan(&userID, &email); err != nil {
+			return err
+		}
+		if email.Valid {
+			emails[strings.ToLower(email.String)] = userID
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading target accounts: %w", err)
+	}
+
+	err = queryTarget(ctx, m.sqliteDB, "SELECT user_id, label FROM books WHERE NOT deleted", func(scan func(...any) error) error {
+		var userID int
+		var label string
+		if err := scan(&userID, &label); err != nil {
+			return err
+		}
+		if p.labels[userID] == nil {
+			p.labels[userID] = map[string]bool{}
+		}
+		p.labels[userID][label] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading target books: %w", err)
+	}
+
+	// Users with an account email the target already has are the same
+	// person, whose new data was collected on the v3 server
+	err = scanSource(ctx, m.src, "accounts", []string{"user_id", "email"}, func(scan func(...any) error) error {
+		var userID int
+		var email sql.NullString
+		if err := scan(&userID, &email); err != nil {
+			return err
+		}
+		if !email.Valid || !m.sel.user(userID) {
+			return nil
+		}
+		if target, ok := emails[strings.ToLower(email.String)]; ok {
+			p.users[userID] = target
+			p.merged[userID] = true
+			p.report.Users = append(p.report.Users, MergedUser{Email: email.String, SourceID: userID, TargetID: target})
+			if maxUSN[target] > 0 {
+				p.usnBase[userID] = maxUSN[target]
+				p.report.USNs = append(p.report.USNs, RebasedUSN{UserID: target, Offset: maxUSN[target]})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading accounts: %w", err)
+	}
+
+	if err := m.checkMergeUUIDs(ctx, p); err != nil {
+		return err
+	}
+
+	m.merge = p
+	return nil
+}
+
+// checkMergeUUIDs fails if a source user, book or note has the uuid of a row
+// in the target, which happens when the same source is merged twice.
+func (m *Migrator) checkMergeUUIDs(ctx context.Context, p *mergePlan) error {
+	var problems []string
+
+	for _, table := range []string{"users", "books", "notes"} {
+		if !m.sel.table(table) {
+			continue
+		}
+
+		taken := map[string]bool{}
+		err := queryTarget(ctx, m.sqliteDB, "SELECT uuid FROM "+table, func(scan func(...any) error) error {
+			var uuid string
+			if err := scan(&uuid); err != nil {
+				return err
+			}
+			taken[uuid] = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading target %s: %w", table, err)
+		}
+
+		owner := "user_id"
+		if table == "users" {
+			owner = "id"
+		}
+
+		var clashes idList
+		err = scanSource(ctx, m.src, table, []string{"id", owner, "uuid"}, func(scan func(...any) error) error {
+			var id, userID int
+			var uuid string
+			if err := scan(&id, &userID, &uuid); err != nil {
+				return err
+			}
+			// A merged user is expected to be there already
+			if table == "users" && p.merged[id] {
+				return nil
+			}
+			if m.sel.user(userID) && taken[uuid] {
+				clashes.add(id)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", table, err)
+		}
+
+		if clashes.count > 0 {
+			problems = append(problems, fmt.Sprintf("%d %s (ids %s)", clashes.count, table, &clashes))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the target already has the uuids of %s - was this source merged into it before?", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// queryTarget calls fn for every row returned by query on db, passing it a
+// function that scans the current row.
+func queryTarget(ctx context.Context, db *sql.DB, query string, fn func(scan func(...any) error) error) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,107 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// laterDump is testDump as it would be on a second server that user 1 went
+// on to use, with the same account email but new uuids for every row.
+func laterDump() string {
+	return strings.NewReplacer(
+		"0b4a4d7e-", "0b4a4d7f-",
+		"7c9e6679-", "7c9e667a-",
+		"2f3a1b4c-", "2f3a1b4d-",
+		"d1c2b3a4-", "d1c2b3a5-",
+		"a1b2c3d4-", "a1b2c3d5-",
+	).Replace(testDump)
+}
+
+func mergeDump(t *testing.T, db *sql.DB, dump string, opts Options) (*Result, error) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, dump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	return New(src, db, opts).Run(context.Background())
+}
+
+func TestMerge(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := mergeDump(t, db, testDump, Options{}); err != nil {
+		t.Fatalf("Failed to create target: %v", err)
+	}
+
+	result, err := mergeDump(t, db, laterDump(), Options{Merge: true, BatchSize: 1})
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+
+	expected := &MergeReport{
+		Users: []MergedUser{{Email: "user1@example.com", SourceID: 1, TargetID: 1}},
+		IDs: []RemappedID{
+			{Table: "users", From: 2, To: 3},
+			{Table: "accounts", From: 2, To: 3},
+			{Table: "books", From: 1, To: 2},
+			{Table: "tokens", From: 1, To: 2},
+			{Table: "sessions", From: 1, To: 2},
+			{Table: "notes", From: 1, To: 4},
+			{Table: "notes", From: 3, To: 5},
+		},
+		Books: []RenamedBook{{UUID: "2f3a1b4d-5d6e-4f70-8a9b-0c1d2e3f4a5b", UserID: 1, From: "golang", To: "golang (2)"}},
+		USNs:  []RebasedUSN{{UserID: 1, Offset: 10}},
+	}
+	if !reflect.DeepEqual(result.Merge, expected) {
+		t.Errorf("Merge: expected %+v, got %+v", expected, result.Merge)
+	}
+
+	stats := MigrationStats{Users: 1, Accounts: 1, Books: 1, Notes: 2, Tokens: 1, Sessions: 1}
+	if result.Stats != stats {
+		t.Errorf("Stats: expected %+v, got %+v", stats, result.Stats)
+	}
+
+	var maxUSN int
+	if err := db.QueryRow("SELECT max_usn FROM users WHERE id = 1").Scan(&maxUSN); err != nil {
+		t.Fatalf("Failed to read user: %v", err)
+	}
+	if maxUSN != 20 {
+		t.Errorf("max_usn: expected 20, got %d", maxUSN)
+	}
+
+	var notes, usns int
+	if err := db.QueryRow("SELECT COUNT(*), SUM(usn) FROM notes WHERE user_id = 1 AND book_uuid = '2f3a1b4d-5d6e-4f70-8a9b-0c1d2e3f4a5b'").Scan(&notes, &usns); err != nil {
+		t.Fatalf("Failed to read notes: %v", err)
+	}
+	if notes != 2 || usns != 12+13 {
+		t.Errorf("Expected the 2 merged notes with USNs 12 and 13, got %d notes with USNs adding up to %d", notes, usns)
+	}
+
+	// Merging the same source again would duplicate its rows
+	_, err = mergeDump(t, db, laterDump(), Options{Merge: true})
+	if err == nil || !strings.Contains(err.Error(), "the target already has the uuids of 1 users (ids 2), 1 books (ids 1), 2 notes (ids 1, 3)") {
+		t.Errorf("Expected a second merge to be refused, got %v", err)
+	}
+}
+
+func TestMergeNeedsTarget(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	_, err = mergeDump(t, db, testDump, Options{Merge: true})
+	if err == nil || !strings.Contains(err.Error(), "target has no users table") {
+		t.Errorf("Expected an empty target to be refused, got %v", err)
+	}
+}
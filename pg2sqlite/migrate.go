@@ -0,0 +1,964 @@
+// Package pg2sqlite copies a Dnote server v2 database, from PostgreSQL or
+// from a plain-format pg_dump of it, into a Dnote v3 SQLite database.
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultBatchSize is the number of rows copied per checkpointed transaction
+// when Options.BatchSize is not set.
+const DefaultBatchSize = 1000
+
+type MigrationStats struct {
+	Users    int
+	Accounts int
+	Books    int
+	Notes    int
+	Tokens   int
+	Sessions int
+
+	// Accounts verified in the source. The v3 schema cannot mark an email
+	// address as verified, so they come out unverified.
+	UnverifiedAccounts int
+
+	// Client-encrypted rows found in the source
+	EncryptedBooks int
+	EncryptedNotes int
+
+	// Rows that reference a missing user or book, and what became of them
+	Orphans OrphanStats
+}
+
+// Options configure a Migrator. The zero value copies in batches of
+// DefaultBatchSize and refuses to migrate encrypted or orphaned rows.
+type Options struct {
+	// BatchSize is the number of rows copied per checkpointed transaction
+	BatchSize int
+	// Workers is the number of tables read from the source at once, ahead
+	// of the table being written
+	Workers int
+	// Encrypted decides what happens to client-encrypted books and notes
+	Encrypted EncryptedPolicy
+	// EncryptedExport receives the rows skipped under EncryptedSkip as JSON
+	// lines, if set
+	EncryptedExport io.Writer
+	// Orphans decides what happens to rows that reference a missing user or
+	// book
+	Orphans OrphanPolicy
+	// Filter selects the users and tables to migrate
+	Filter Filter
+	// Merge adds the source to the Dnote v3 database already in the target
+	// instead of creating the schema, fitting ids, users, USNs and book
+	// labels around the rows there
+	Merge bool
+	// Progress is called after every committed batch, if set
+	Progress func(Progress)
+	// Logf receives a line for each step of the migration, if set
+	Logf func(format string, args ...any)
+}
+
+// Result describes a completed migration.
+type Result struct {
+	Schema *SchemaReport
+	Stats  MigrationStats
+	Tables []TableStats
+	// Skipped lists the source rows left out of the target
+	Skipped []SkippedRow
+	// Unverified lists the source ids of the accounts counted in
+	// MigrationStats.UnverifiedAccounts
+	Unverified []int
+	// Warnings are problems that did not stop the migration
+	Warnings []string
+	// Merge describes how the source was merged, if Options.Merge was set
+	Merge *MergeReport
+}
+
+// TableStats describes the copy of one table. A resumed run only counts the
+// rows after the table's checkpoint.
+type TableStats struct {
+	Name    string
+	Read    int
+	Written int
+	Skipped int
+	// Filtered counts the rows of users not selected by the Filter
+	Filtered int
+	// Deleted counts the rows a sync removed from the target, as they are
+	// gone from the source
+	Deleted  int
+	Duration time.Duration
+	// DroppedColumns are the source columns the target has no place for
+	DroppedColumns []string
+}
+
+// Reasons for skipping a source row.
+const (
+	SkipEncrypted = "encrypted"
+	SkipOrphan    = "orphan"
+	SkipMerged    = "merged"
+)
+
+// SkippedRow is a source row that was left out of the target.
+type SkippedRow struct {
+	Table  string
+	ID     int
+	Reason string
+}
+
+// Migrator copies a Dnote v2 database into a Dnote v3 SQLite database. It
+// holds the settings and running totals of a single run.
+type Migrator struct {
+	src       Source
+	sqliteDB  *sql.DB
+	batchSize int
+	workers   int
+	encrypted EncryptedPolicy
+	// export receives the encrypted rows skipped under EncryptedSkip, if set
+	export   *json.Encoder
+	orphans  OrphanPolicy
+	filter   Filter
+	merging  bool
+	syncing  bool // set by Sync
+	progress func(Progress)
+	logf     func(format string, args ...any)
+
+	schema     *SchemaReport // set once Check has passed
+	sel        *selection    // set by Check
+	orphanPlan *orphanPlan   // set by Check if the source has orphans
+	merge      *mergePlan    // set by Run when merging
+	ahead      *readAhead    // set by run when reading tables ahead
+	stats      MigrationStats
+	tables     []TableStats
+	skipped    []SkippedRow
+	unverified []int
+	warnings   []string
+}
+
+// New returns a Migrator that reads from src and writes to target. target
+// must be a SQLite database opened with the sqlite3 driver, built with the
+// fts5 tag, preferably with SQLiteLoadParams so that every connection
+// enforces foreign keys. It may be nil if the Migrator is only used to Check
+// or Plan.
+//
+// A migration that was interrupted can be continued by running a new
+// Migrator against the same target: every table picks up after the last
+// batch committed to it.
+func New(src Source, target *sql.DB, opts Options) *Migrator {
+	m := &Migrator{
+		src:       src,
+		sqliteDB:  target,
+		batchSize: opts.BatchSize,
+		workers:   opts.Workers,
+		encrypted: opts.Encrypted,
+		orphans:   opts.Orphans,
+		filter:    opts.Filter,
+		merging:   opts.Merge,
+		progress:  opts.Progress,
+		logf:      opts.Logf,
+	}
+
+	if m.batchSize <= 0 {
+		m.batchSize = DefaultBatchSize
+	}
+	if m.encrypted == "" {
+		m.encrypted = EncryptedFail
+	}
+	if m.orphans == "" {
+		m.orphans = OrphanFail
+	}
+	if opts.EncryptedExport != nil {
+		m.export = json.NewEncoder(opts.EncryptedExport)
+	}
+	if m.progress == nil {
+		m.progress = func(Progress) {}
+	}
+	if m.logf == nil {
+		m.logf = func(string, ...any) {}
+	}
+
+	return m
+}
+
+// batch is the outcome of copying one batch of rows.
+type batch struct {
+	lastID   int // id of the last row read
+	read     int // rows read from the source
+	written  int // rows written to SQLite
+	filtered int // rows of users not selected
+}
+
+// batchFunc copies up to limit rows from rows, which are in id order.
+type batchFunc func(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error)
+
+// Check makes sure the source can be migrated before anything is written:
+// it detects the source schema, looks up the users selected by the filter
+// and applies the encrypted and orphan policies. Run calls it as well, so it
+// only needs to be called to fail before creating the target.
+func (m *Migrator) Check(ctx context.Context) error {
+	if m.schema != nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Make sure the source is a supported Dnote schema
+	m.logf("Checking source schema...")
+	report, err := checkSchema(ctx, m.src)
+	if err != nil {
+		return err
+	}
+	m.logf("Detected %s", report)
+
+	// Find the users and tables to migrate
+	sel, err := resolveFilter(ctx, m.src, m.filter)
+	if err != nil {
+		return err
+	}
+	if sel.users != nil {
+		m.logf("Migrating %d selected users", len(sel.users))
+	}
+	m.sel = sel
+
+	// Decide what to do with encrypted rows
+	m.logf("Checking for encrypted books and notes...")
+	if err := m.checkEncrypted(ctx); err != nil {
+		return err
+	}
+
+	// Decide what to do with rows that reference a missing user or book
+	m.logf("Checking for orphaned rows...")
+	if err := m.checkOrphans(ctx); err != nil {
+		return err
+	}
+
+	m.schema = report
+	return nil
+}
+
+// Run migrates the source into the target, creating the Dnote v3 schema
+// first, and checks the integrity of the result. Once ctx is done, the query
+// in flight is interrupted and the batch being copied is rolled back, so the
+// target is left as of its last checkpoint.
+func (m *Migrator) Run(ctx context.Context) (*Result, error) {
+	if err := m.Check(ctx); err != nil {
+		return nil, err
+	}
+
+	// Reject rows that break a reference as soon as they are inserted
+	if _, err := m.sqliteDB.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
+		return nil, fmt.Errorf("enabling foreign keys: %w", err)
+	}
+
+	if m.merging {
+		m.logf("Planning merge into the existing database...")
+		if err := m.checkMergeTarget(ctx); err != nil {
+			return nil, err
+		}
+		if err := m.planMerge(ctx); err != nil {
+			return nil, fmt.Errorf("planning merge: %w", err)
+		}
+
+		// Ids no longer match the source's, so the result cannot be synced
+		if err := dropSyncMark(ctx, m.sqliteDB); err != nil {
+			return nil, fmt.Errorf("dropping sync mark: %w", err)
+		}
+	} else {
+		m.logf("Creating SQLite schema...")
+		if err := initSchema(ctx, m.sqliteDB); err != nil {
+			return nil, fmt.Errorf("initializing SQLite schema: %w", err)
+		}
+
+		// Read the source's clock before any rows, so that a later sync
+		// picks up whatever changes while they are copied
+		mark, err := m.src.now(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading the source's clock: %w", err)
+		}
+		settings, err := m.syncSettings()
+		if err != nil {
+			return nil, err
+		}
+		if err := initSyncMark(ctx, m.sqliteDB, mark, settings); err != nil {
+			return nil, fmt.Errorf("recording sync mark: %w", err)
+		}
+	}
+
+	if err := m.run(ctx); err != nil {
+		return nil, err
+	}
+
+	m.logf("Checking database integrity...")
+	if err := checkIntegrity(ctx, m.sqliteDB); err != nil {
+		return nil, fmt.Errorf("checking database integrity: %w", err)
+	}
+
+	if err := m.findDroppedColumns(ctx); err != nil {
+		return nil, fmt.Errorf("comparing columns: %w", err)
+	}
+
+	if err := m.findUnverified(ctx); err != nil {
+		return nil, fmt.Errorf("reading verified accounts: %w", err)
+	}
+
+	result := &Result{Schema: m.schema, Stats: m.stats, Tables: m.tables, Skipped: m.skipped, Unverified: m.unverified, Warnings: m.warnings}
+	if m.merge != nil {
+		result.Merge = &m.merge.report
+	}
+
+	return result, nil
+}
+
+// warnf records a problem that does not stop the migration.
+func (m *Migrator) warnf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	m.warnings = append(m.warnings, msg)
+	m.logf("Warning: %s", msg)
+}
+
+func (m *Migrator) run(ctx context.Context) error {
+	if err := initCheckpoints(ctx, m.sqliteDB); err != nil {
+		return fmt.Errorf("creating checkpoint table: %w", err)
+	}
+
+	if m.workers > 1 {
+		ahead, err := m.startReadAhead(ctx)
+		if err != nil {
+			return err
+		}
+		defer ahead.stop()
+
+		m.ahead = ahead
+		defer func() { m.ahead = nil }()
+	}
+
+	for _, t := range m.tableCopies() {
+		if !m.sel.table(t.name) {
+			m.logf("Skipping %s", t.name)
+			continue
+		}
+
+		m.logf("Migrating %s...", t.name)
+		if err := m.migrateTable(ctx, t.name, t.fn, t.count); err != nil {
+			return fmt.Errorf("migrating %s: %w", t.name, err)
+		}
+		m.logf("  Migrated %d %s", *t.count, t.name)
+
+		// Create the books that notes without one are moved into
+		if t.name == "books" {
+			if err := m.insertRecoveredBooks(ctx); err != nil {
+				return fmt.Errorf("creating recovered books: %w", err)
+			}
+		}
+	}
+
+	// Start the final transaction
+	tx, err := m.sqliteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Check the full-text index populated by the triggers
+	m.logf("Checking full-text search index...")
+	if err := checkFTSIndex(ctx, tx); err != nil {
+		return fmt.Errorf("checking full-text search index: %w", err)
+	}
+
+	// Connections opened without foreign keys enforced would have let
+	// broken references through
+	m.logf("Checking foreign keys...")
+	if err := checkForeignKeys(ctx, tx); err != nil {
+		return fmt.Errorf("checking foreign keys: %w", err)
+	}
+
+	// Every table is done, so the checkpoints are no longer needed
+	if err := dropCheckpoints(ctx, tx); err != nil {
+		return fmt.Errorf("dropping checkpoint table: %w", err)
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// tableCopy is how the rows of a table are copied, and where their count is
+// kept.
+type tableCopy struct {
+	name  string
+	fn    batchFunc
+	count *int
+}
+
+// tableCopies lists the tables in the order they are copied, parents first.
+// Notes go last so that the full-text index is built by their triggers.
+func (m *Migrator) tableCopies() []tableCopy {
+	stats := &m.stats
+
+	return []tableCopy{
+		{"users", m.migrateUsers, &stats.Users},
+		{"accounts", m.migrateAccounts, &stats.Accounts},
+		{"books", m.migrateBooks, &stats.Books},
+		{"tokens", m.migrateTokens, &stats.Tokens},
+		{"sessions", m.migrateSessions, &stats.Sessions},
+		{"notes", m.migrateNotes, &stats.Notes},
+	}
+}
+
+// inserter returns a batchInserter for table, which overwrites the rows
+// already in the target during a sync.
+func (m *Migrator) inserter(ctx context.Context, tx *sql.Tx, table string, columns []string) *batchInserter {
+	ins := newBatchInserter(ctx, tx, table, columns, insertRowsPerStatement)
+	ins.upsert = m.syncing
+
+	return ins
+}
+
+// migrateTable copies table in batches, committing each batch together with
+// its checkpoint. It picks up after the last committed batch if the table was
+// partially migrated by an earlier run. count is kept up to date with the
+// number of rows written so far.
+func (m *Migrator) migrateTable(ctx context.Context, table string, fn batchFunc, count *int) error {
+	cp, err := loadCheckpoint(ctx, m.sqliteDB, table)
+	if err != nil {
+		return fmt.Errorf("loading checkpoint: %w", err)
+	}
+	*count = cp.Rows
+
+	ts := TableStats{Name: table}
+	defer func() { m.tables = append(m.tables, ts) }()
+
+	if cp.Done {
+		m.logf("  Already migrated")
+		m.progress(Progress{Table: table, Rows: cp.Rows, Done: true})
+		return nil
+	}
+	if cp.LastID > 0 {
+		m.logf("  Resuming after id %d (%d rows already migrated)", cp.LastID, cp.Rows)
+	}
+
+	// Count first, so that progress can be reported against a total
+	total, err := m.src.countRows(ctx, table, cp.LastID)
+	if err != nil {
+		return fmt.Errorf("counting rows: %w", err)
+	}
+
+	src, err := m.openRows(ctx, table, cp.LastID)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	rows := &measuringRows{sourceRows: src}
+	p := Progress{Table: table, Rows: cp.Rows, Total: total}
+	start := time.Now()
+
+	for !cp.Done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tx, err := m.sqliteDB.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("starting transaction: %w", err)
+		}
+
+		b, err := fn(ctx, tx, rows, m.batchSize)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if b.read > 0 {
+			cp.LastID = b.lastID
+			cp.Rows += b.written
+		}
+		cp.Done = b.read < m.batchSize
+
+		if err := saveCheckpoint(ctx, tx, table, cp); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("committing batch: %w", err)
+		}
+
+		*count = cp.Rows
+		ts.Read += b.read
+		ts.Written += b.written
+		ts.Filtered += b.filtered
+		ts.Skipped = ts.Read - ts.Written - ts.Filtered
+		ts.Duration = time.Since(start)
+		p.Rows, p.Read, p.Bytes, p.Elapsed, p.Done = cp.Rows, p.Read+b.read, rows.bytes, time.Since(start), cp.Done
+		m.progress(p)
+	}
+
+	return nil
+}
+
+// openRows returns the rows of table after afterID, from the reader that is
+// reading them ahead if there is one.
+func (m *Migrator) openRows(ctx context.Context, table string, afterID int) (sourceRows, error) {
+	if rows := m.ahead.rows(table); rows != nil {
+		return rows, nil
+	}
+
+	return m.src.rows(ctx, table, sourceColumns[table], afterID)
+}
+
+// checkIntegrity runs SQLite's integrity check on db.
+func checkIntegrity(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+func (m *Migrator) skip(table string, id int, reason string) {
+	m.skipped = append(m.skipped, SkippedRow{Table: table, ID: id, Reason: reason})
+}
+
+// findUnverified records the source accounts written to the target that
+// were verified. They are looked up in the source rather than counted as
+// they are copied, as a resumed run only copies some accounts itself.
+func (m *Migrator) findUnverified(ctx context.Context) error {
+	if !m.sel.table("accounts") {
+		return nil
+	}
+
+	m.stats.UnverifiedAccounts, m.unverified = 0, nil
+	return scanSource(ctx, m.src, "accounts", []string{"id", "user_id", "email_verified"}, func(scan func(...any) error) error {
+		var id, userID int
+		var verified bool
+		if err := scan(&id, &userID, &verified); err != nil {
+			return err
+		}
+		if !verified || !m.sel.user(userID) || m.isDropped("accounts", id) || (m.merge != nil && m.merge.merged[userID]) {
+			return nil
+		}
+
+		m.stats.UnverifiedAccounts++
+		m.unverified = append(m.unverified, id)
+		return nil
+	})
+}
+
+// findDroppedColumns records, for every table, the source columns that the
+// target table does not have.
+func (m *Migrator) findDroppedColumns(ctx context.Context) error {
+	for i, ts := range m.tables {
+		target, err := sqliteColumns(ctx, m.sqliteDB, ts.Name)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range m.schema.Tables {
+			if t.Name != ts.Name {
+				continue
+			}
+			for _, c := range t.Columns {
+				if !target[c] {
+					m.tables[i].DroppedColumns = append(m.tables[i].DroppedColumns, c)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// sqliteColumns returns the set of columns of table in db.
+func sqliteColumns(ctx context.Context, db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
+
+// checkForeignKeys fails if any row references a row that does not exist,
+// listing the broken references by table.
+func checkForeignKeys(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var tables []string
+	broken := map[string]*idList{}
+	for rows.Next() {
+		var table, parent string
+		var rowID, fkID int
+		if err := rows.Scan(&table, &rowID, &parent, &fkID); err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("%s rows reference missing %s", table, parent)
+		if broken[key] == nil {
+			broken[key] = &idList{}
+			tables = append(tables, key)
+		}
+		broken[key].add(rowID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(tables) == 0 {
+		return nil
+	}
+
+	problems := make([]string, len(tables))
+	for i, key := range tables {
+		problems[i] = fmt.Sprintf("%d %s (ids %s)", broken[key].count, key, broken[key])
+	}
+
+	return fmt.Errorf("%s", strings.Join(problems, "; "))
+}
+
+func (m *Migrator) migrateUsers(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "users", []string{"id", "created_at", "updated_at", "uuid", "last_login_at", "max_usn"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, maxUSN int
+		var createdAt, updatedAt time.Time
+		var uuid string
+		var lastLoginAt sql.NullTime
+		var cloud bool // Read but ignore
+
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &uuid, &lastLoginAt, &maxUSN, &cloud); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(id) {
+			b.filtered++
+			continue
+		}
+
+		// Reparented notes and their books take USNs above the user's
+		if m.orphanPlan != nil {
+			if usn, ok := m.orphanPlan.maxUSN[id]; ok {
+				maxUSN = usn
+			}
+		}
+
+		// A user already in the target keeps its row, and only moves its
+		// max_usn past the USNs of the books and notes merged into it
+		if m.merge != nil && m.merge.merged[id] {
+			if _, err := tx.ExecContext(ctx, "UPDATE users SET max_usn = MAX(max_usn, ?) WHERE id = ?", m.merge.usn(id, maxUSN), m.merge.user(id)); err != nil {
+				return batch{}, fmt.Errorf("updating merged user %d: %w", id, err)
+			}
+			m.skip("users", id, SkipMerged)
+			continue
+		}
+		if m.merge != nil {
+			m.merge.users[id] = m.merge.id("users", id)
+		}
+
+		if err := ins.add(m.merge.user(id), createdAt, updatedAt, uuid, lastLoginAt, maxUSN); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
+
+func (m *Migrator) migrateAccounts(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "accounts", []string{"id", "created_at", "updated_at", "user_id", "email", "password"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, userID int
+		var createdAt, updatedAt time.Time
+		var email, password sql.NullString
+		var emailVerified bool
+
+		// SQLite has no email_verified column, so findUnverified reports the
+		// verified accounts instead
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &userID, &email, &emailVerified, &password); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(userID) {
+			b.filtered++
+			continue
+		}
+		if m.isDropped("accounts", id) {
+			m.skip("accounts", id, SkipOrphan)
+			continue
+		}
+		if m.merge != nil && m.merge.merged[userID] {
+			m.skip("accounts", id, SkipMerged)
+			continue
+		}
+
+		if err := ins.add(m.merge.id("accounts", id), createdAt, updatedAt, m.merge.user(userID), email, password); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
+
+func (m *Migrator) migrateBooks(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "books", []string{"id", "created_at", "updated_at", "uuid", "user_id", "label", "added_on", "edited_on", "usn", "deleted"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, userID, usn int
+		var addedOn, editedOn int64
+		var createdAt, updatedAt time.Time
+		var uuid, label string
+		var deleted, encrypted bool
+
+		// SQLite has no encrypted column, so encrypted books are handled
+		// according to the policy instead
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &uuid, &userID, &label, &addedOn, &editedOn, &usn, &deleted, &encrypted); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(userID) {
+			b.filtered++
+			continue
+		}
+		if encrypted && m.encrypted == EncryptedSkip {
+			if err := m.exportEncrypted(EncryptedRecord{
+				Table: "books", ID: id, CreatedAt: createdAt, UpdatedAt: updatedAt, UUID: uuid, UserID: userID,
+				Label: label, AddedOn: addedOn, EditedOn: editedOn, USN: usn, Deleted: deleted,
+			}); err != nil {
+				return batch{}, err
+			}
+			m.skip("books", id, SkipEncrypted)
+			continue
+		}
+		if m.isDropped("books", id) {
+			m.skip("books", id, SkipOrphan)
+			continue
+		}
+		if m.merge != nil {
+			usn = m.merge.usn(userID, usn)
+			userID = m.merge.user(userID)
+			label = m.merge.label(userID, uuid, label, deleted)
+			id = m.merge.id("books", id)
+		}
+
+		if err := ins.add(id, createdAt, updatedAt, uuid, userID, label, addedOn, editedOn, usn, deleted); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
+
+func (m *Migrator) migrateNotes(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "notes", []string{"id", "created_at", "updated_at", "uuid", "user_id", "book_uuid", "body", "added_on", "edited_on", "public", "usn", "deleted", "client"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, userID, usn int
+		var addedOn, editedOn int64
+		var createdAt, updatedAt time.Time
+		var uuid, bookUUID, body, client string
+		var public, deleted, encrypted bool
+
+		// SQLite has no encrypted column, so encrypted notes are handled
+		// according to the policy instead
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &uuid, &userID, &bookUUID, &body, &addedOn, &editedOn, &public, &usn, &deleted, &encrypted, &client); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(userID) {
+			b.filtered++
+			continue
+		}
+		if encrypted && m.encrypted == EncryptedSkip {
+			if err := m.exportEncrypted(EncryptedRecord{
+				Table: "notes", ID: id, CreatedAt: createdAt, UpdatedAt: updatedAt, UUID: uuid, UserID: userID,
+				BookUUID: bookUUID, Body: body, AddedOn: addedOn, EditedOn: editedOn, Public: public, USN: usn,
+				Deleted: deleted, Client: client,
+			}); err != nil {
+				return batch{}, err
+			}
+			m.skip("notes", id, SkipEncrypted)
+			continue
+		}
+		if m.isDropped("notes", id) {
+			m.skip("notes", id, SkipOrphan)
+			continue
+		}
+		if m.orphanPlan != nil {
+			if r, ok := m.orphanPlan.reparented[id]; ok {
+				bookUUID, usn = r.bookUUID, r.usn
+			}
+		}
+		if m.merge != nil {
+			usn = m.merge.usn(userID, usn)
+			userID = m.merge.user(userID)
+			id = m.merge.id("notes", id)
+		}
+
+		if err := ins.add(id, createdAt, updatedAt, uuid, userID, bookUUID, body, addedOn, editedOn, public, usn, deleted, client); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
+
+func (m *Migrator) migrateTokens(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "tokens", []string{"id", "created_at", "updated_at", "user_id", "value", "type", "used_at"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, userID int
+		var createdAt, updatedAt time.Time
+		var value, tokenType string
+		var usedAt sql.NullTime
+
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &userID, &value, &tokenType, &usedAt); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(userID) {
+			b.filtered++
+			continue
+		}
+		if m.isDropped("tokens", id) {
+			m.skip("tokens", id, SkipOrphan)
+			continue
+		}
+
+		if err := ins.add(m.merge.id("tokens", id), createdAt, updatedAt, m.merge.user(userID), value, tokenType, usedAt); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
+
+func (m *Migrator) migrateSessions(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+	ins := m.inserter(ctx, tx, "sessions", []string{"id", "created_at", "updated_at", "user_id", "key", "last_used_at", "expires_at"})
+	defer ins.close()
+
+	var b batch
+
+	for b.read < limit && rows.Next() {
+		var id, userID int
+		var createdAt, updatedAt, lastUsedAt, expiresAt time.Time
+		var key string
+
+		if err := rows.Scan(&id, &createdAt, &updatedAt, &userID, &key, &lastUsedAt, &expiresAt); err != nil {
+			return batch{}, err
+		}
+		b.lastID = id
+		b.read++
+
+		if !m.sel.user(userID) {
+			b.filtered++
+			continue
+		}
+		if m.isDropped("sessions", id) {
+			m.skip("sessions", id, SkipOrphan)
+			continue
+		}
+
+		if err := ins.add(m.merge.id("sessions", id), createdAt, updatedAt, m.merge.user(userID), key, lastUsedAt, expiresAt); err != nil {
+			return batch{}, err
+		}
+		b.written++
+	}
+
+	if err := rows.Err(); err != nil {
+		return batch{}, err
+	}
+
+	return b, ins.flush()
+}
@@ -0,0 +1,272 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigratorRun(t *testing.T) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, testDump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	var progress []Progress
+	m := New(src, db, Options{
+		BatchSize: 1,
+		Progress:  func(p Progress) { progress = append(progress, p) },
+	})
+
+	result, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := MigrationStats{Users: 2, Accounts: 2, UnverifiedAccounts: 1, Books: 1, Notes: 2, Tokens: 1, Sessions: 1}
+	if result.Stats != expected {
+		t.Errorf("Stats: expected %+v, got %+v", expected, result.Stats)
+	}
+	if fmt.Sprint(result.Unverified) != "[1]" {
+		t.Errorf("Unverified: expected [1], got %v", result.Unverified)
+	}
+	if result.Schema == nil || result.Schema.Version != schemaVersionV2 {
+		t.Errorf("Schema: expected %s, got %+v", schemaVersionV2, result.Schema)
+	}
+	if result.Schema.ServerVersion != "12.17" || !strings.HasPrefix(result.Schema.Fingerprint, "sha256:") {
+		t.Errorf("Schema: expected server version 12.17 and a fingerprint, got %q and %q", result.Schema.ServerVersion, result.Schema.Fingerprint)
+	}
+
+	dropped := map[string]string{}
+	for _, ts := range result.Tables {
+		if ts.Read != ts.Written+ts.Skipped {
+			t.Errorf("%s: read %d rows but wrote %d and skipped %d", ts.Name, ts.Read, ts.Written, ts.Skipped)
+		}
+		dropped[ts.Name] = strings.Join(ts.DroppedColumns, ",")
+	}
+	expectedDropped := map[string]string{"users": "cloud", "accounts": "email_verified", "books": "encrypted", "notes": "tsv,encrypted", "tokens": "", "sessions": ""}
+	if fmt.Sprint(dropped) != fmt.Sprint(expectedDropped) {
+		t.Errorf("Dropped columns: expected %v, got %v", expectedDropped, dropped)
+	}
+
+	// One update per batch of one row, plus the empty batch that ends a table
+	var notes []Progress
+	for _, p := range progress {
+		if p.Table == "notes" {
+			if p.Bytes == 0 || p.Elapsed == 0 {
+				t.Errorf("notes progress: expected bytes and elapsed time, got %+v", p)
+			}
+			p.Bytes, p.Elapsed = 0, 0
+			notes = append(notes, p)
+		}
+	}
+	expectedNotes := []Progress{
+		{Table: "notes", Rows: 1, Read: 1, Total: 2},
+		{Table: "notes", Rows: 2, Read: 2, Total: 2},
+		{Table: "notes", Rows: 2, Read: 2, Total: 2, Done: true},
+	}
+	if fmt.Sprint(notes) != fmt.Sprint(expectedNotes) {
+		t.Errorf("notes progress: expected %v, got %v", expectedNotes, notes)
+	}
+
+	ok, err := HasCheckpoints(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Failed to check for checkpoints: %v", err)
+	}
+	if ok {
+		t.Error("expected checkpoints to be dropped after a complete run")
+	}
+}
+
+func TestMigratorRunCanceled(t *testing.T) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, testDump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	db := openTestSQLite(t, "canceled.db")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := New(src, db, Options{
+		BatchSize: 1,
+		Progress: func(p Progress) {
+			if p.Table == "users" {
+				cancel()
+			}
+		},
+	})
+
+	if _, err := m.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected Run to stop with context.Canceled, got %v", err)
+	}
+
+	var users int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+		t.Fatalf("Failed to count users: %v", err)
+	}
+	if users != 1 {
+		t.Errorf("users: expected the first batch only, got %d", users)
+	}
+}
+
+// fakeUserSource serves users with ids 1..total, failing when it reaches
+// failAt unless failAt is 0.
+type fakeUserSource struct {
+	total  int
+	failAt int
+}
+
+func (s *fakeUserSource) rows(ctx context.Context, table string, columns []string, afterID int) (sourceRows, error) {
+	return &fakeUserRows{src: s, id: afterID}, nil
+}
+
+func (s *fakeUserSource) countRows(ctx context.Context, table string, afterID int) (int, error) {
+	return max(s.total-afterID, 0), nil
+}
+
+func (s *fakeUserSource) changedRows(ctx context.Context, table string, columns []string, c changes) (sourceRows, error) {
+	return s.rows(ctx, table, columns, 0)
+}
+
+func (s *fakeUserSource) now(ctx context.Context) (time.Time, error) { return time.Time{}, nil }
+
+func (s *fakeUserSource) tableColumns(ctx context.Context, table string) ([]string, error) {
+	return nil, nil
+}
+func (s *fakeUserSource) appliedMigrations(ctx context.Context) ([]string, error) { return nil, nil }
+func (s *fakeUserSource) serverVersion(ctx context.Context) (string, error)       { return "", nil }
+func (s *fakeUserSource) Close() error                                            { return nil }
+
+type fakeUserRows struct {
+	src *fakeUserSource
+	id  int
+	err error
+}
+
+func (r *fakeUserRows) Next() bool {
+	if r.id >= r.src.total {
+		return false
+	}
+	if r.src.failAt > 0 && r.id+1 >= r.src.failAt {
+		r.err = fmt.Errorf("connection lost")
+		return false
+	}
+
+	r.id++
+	return true
+}
+
+func (r *fakeUserRows) Scan(dest ...any) error {
+	*dest[0].(*int) = r.id
+	return nil
+}
+
+func (r *fakeUserRows) Err() error   { return r.err }
+func (r *fakeUserRows) Close() error { return nil }
+
+func TestMigrateTableResume(t *testing.T) {
+	db := openTestSQLite(t, "resume.db")
+	if err := initCheckpoints(context.Background(), db); err != nil {
+		t.Fatalf("Failed to create checkpoint table: %v", err)
+	}
+
+	copyUsers := func(ctx context.Context, tx *sql.Tx, rows sourceRows, limit int) (batch, error) {
+		var b batch
+		for b.read < limit && rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return batch{}, err
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO users (id, created_at, updated_at, uuid, max_usn) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, 0)", id, fmt.Sprintf("uuid-%d", id)); err != nil {
+				return batch{}, err
+			}
+			b.lastID = id
+			b.read++
+			b.written++
+		}
+		return b, rows.Err()
+	}
+
+	// The source fails in the middle of the second batch
+	src := &fakeUserSource{total: 5, failAt: 4}
+	m := New(src, db, Options{BatchSize: 2})
+
+	var count int
+	if err := m.migrateTable(context.Background(), "users", copyUsers, &count); err == nil {
+		t.Fatal("expected first run to fail")
+	}
+	if count != 2 {
+		t.Errorf("count after failure: expected 2, got %d", count)
+	}
+
+	cp, err := loadCheckpoint(context.Background(), db, "users")
+	if err != nil {
+		t.Fatalf("Failed to load checkpoint: %v", err)
+	}
+	if cp.LastID != 2 || cp.Rows != 2 || cp.Done {
+		t.Errorf("checkpoint after failure: expected {2 2 false}, got %+v", cp)
+	}
+
+	// Resume without the failure
+	src.failAt = 0
+	if err := m.migrateTable(context.Background(), "users", copyUsers, &count); err != nil {
+		t.Fatalf("Resumed run failed: %v", err)
+	}
+	if count != src.total {
+		t.Errorf("count after resume: expected %d, got %d", src.total, count)
+	}
+
+	var userCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount); err != nil {
+		t.Fatalf("Failed to count users: %v", err)
+	}
+	if userCount != src.total {
+		t.Errorf("users: expected %d, got %d", src.total, userCount)
+	}
+
+	cp, err = loadCheckpoint(context.Background(), db, "users")
+	if err != nil {
+		t.Fatalf("Failed to load checkpoint: %v", err)
+	}
+	if cp.LastID != src.total || cp.Rows != src.total || !cp.Done {
+		t.Errorf("checkpoint after resume: expected {%d %d true}, got %+v", src.total, src.total, cp)
+	}
+}
+
+func TestCheckForeignKeys(t *testing.T) {
+	// openTestSQLite does not enforce foreign keys, so the broken note goes in
+	db := openTestSQLite(t, "fk.db")
+	if _, err := db.Exec(`INSERT INTO notes (id, created_at, updated_at, uuid, user_id, book_uuid, body, added_on, edited_on, usn, client)
+		VALUES (7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, 'note-7', 1, 'missing', 'body', 0, 0, 1, 'cli')`); err != nil {
+		t.Fatalf("Failed to insert note: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	err = checkForeignKeys(context.Background(), tx)
+	if err == nil {
+		t.Fatal("expected the broken references to be reported")
+	}
+	for _, want := range []string{"1 notes rows reference missing books (ids 7)", "1 notes rows reference missing users (ids 7)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package pg2sqlite
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OrphanPolicy decides what happens to rows that reference a row missing
+// from the source, such as notes whose book was deleted. Dnote v2 did not
+// enforce these references, so old databases can have any number of them,
+// while the v3 schema does not allow any.
+type OrphanPolicy string
+
+const (
+	// OrphanDrop leaves orphans out
+	OrphanDrop OrphanPolicy = "drop"
+	// OrphanReparent moves notes whose book is missing into a "Recovered"
+	// book of their user, and drops the orphans that cannot be moved
+	OrphanReparent OrphanPolicy = "reparent"
+	// OrphanFail refuses to migrate a source with orphans
+	OrphanFail OrphanPolicy = "fail"
+)
+
+// recoveredBookLabel is the label of the book created by OrphanReparent.
+const recoveredBookLabel = "Recovered"
+
+// ParseOrphanPolicy parses the name of an OrphanPolicy.
+func ParseOrphanPolicy(s string) (OrphanPolicy, error) {
+	switch p := OrphanPolicy(s); p {
+	case OrphanDrop, OrphanReparent, OrphanFail:
+		return p, nil
+	case "keep":
+		return "", fmt.Errorf("the keep orphan policy has been removed, as Dnote v3 refuses rows that reference a missing user or book: use drop, reparent or fail")
+	}
+
+	return "", fmt.Errorf("invalid orphan policy %q: must be drop, reparent or fail", s)
+}
+
+// OrphanStats counts the orphans found in the source and what the policy did
+// with them.
+type OrphanStats struct {
+	BooksWithoutUser    int
+	NotesWithoutUser    int
+	NotesWithoutBook    int
+	AccountsWithoutUser int
+	TokensWithoutUser   int
+	SessionsWithoutUser int
+
+	Dropped        int // rows left out
+	Reparented     int // notes moved into a recovered book
+	RecoveredBooks int // books created to hold them
+}
+
+// Total is the number of orphaned rows.
+func (s OrphanStats) Total() int {
+	return s.BooksWithoutUser + s.NotesWithoutUser + s.NotesWithoutBook +
+		s.AccountsWithoutUser + s.TokensWithoutUser + s.SessionsWithoutUser
+}
+
+// recoveredBook is a book created to hold the orphaned notes of a user.
+type recoveredBook struct {
+	id        int
+	uuid      string
+	userID    int
+	label     string
+	usn       int
+	updatedAt time.Time
+}
+
+// reparentedNote is where a note without a book is moved to.
+type reparentedNote struct {
+	bookUUID string
+	usn      int
+}
+
+// orphanPlan is the outcome of the orphan policy for every affected row. It
+// is derived from the source alone, so a resumed run makes the same choices.
+type orphanPlan struct {
+	dropped    map[string]map[int]bool
+	reparented map[int]reparentedNote
+	books      []recoveredBook
+	// maxUSN is the new max_usn of users whose notes were reparented
+	maxUSN map[int]int
+}
+
+func (p *orphanPlan) drop(table string, id int) {
+	if p.dropped[table] == nil {
+		p.dropped[table] = map[int]bool{}
+	}
+	p.dropped[table][id] = true
+}
+
+// isDropped reports whether the row of table with id is left out.
+func (m *Migrator) isDropped(table string, id int) bool {
+	return m.orphanPlan != nil && m.orphanPlan.dropped[table][id]
+}
+
+// orphanUser is what the orphan check needs to know about a user.
+type orphanUser struct {
+	uuid   string
+	maxUSN int
+	labels map[string]bool
+}
+
+// checkOrphans finds every row that references a missing user or book and
+// applies the orphan policy to it, failing under OrphanFail. Rows left out by
+// the filter are not considered: a filter on users leaves out every row of a
+// missing user.
+func (m *Migrator) checkOrphans(ctx context.Context) error {
+	stats := &m.stats.Orphans
+	plan := &orphanPlan{dropped: map[string]map[int]bool{}, reparented: map[int]reparentedNote{}, maxUSN: map[int]int{}}
+
+	// The ids of the orphans of each table, for the error that refuses them
+	found := map[string]*idList{}
+	orphan := func(table string, id int) {
+		if found[table] == nil {
+			found[table] = &idList{}
+		}
+		found[table].add(id)
+	}
+
+	users := map[int]*orphanUser{}
+	err := scanSource(ctx, m.src, "users", []string{"id", "uuid", "max_usn"}, func(scan func(...any) error) error {
+		var id int
+		u := &orphanUser{labels: map[string]bool{}}
+		if err := scan(&id, &u.uuid, &u.maxUSN); err != nil {
+			return err
+		}
+		users[id] = u
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reading users: %w", err)
+	}
+
+	for _, t := range []struct {
+		table string
+		count *int
+	}{
+		{"accounts", &stats.AccountsWithoutUser},
+		{"tokens", &stats.TokensWithoutUser},
+		{"sessions", &stats.SessionsWithoutUser},
+	} {
+		if !m.sel.table(t.table) {
+			continue
+		}
+
+		err := scanSource(ctx, m.src, t.table, []string{"id", "user_id"}, func(scan func(...any) error) error {
+			var id, userID int
+			if err := scan(&id, &userID); err != nil {
+				return err
+			}
+			if !m.sel.user(userID) {
+				return nil
+			}
+			if users[userID] == nil {
+				*t.count++
+				orphan(t.table, id)
+				plan.drop(t.table, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", t.table, err)
+		}
+	}
+
+	// Books that will not be migrated leave their notes without a book
+	books := map[string]bool{}
+	maxBookID := 0
+	if m.sel.table("books") {
+		err := scanSource(ctx, m.src, "books", []string{"id", "uuid", "user_id", "label", "encrypted"}, func(scan func(...any) error) error {
+			var id, userID int
+			var uuid, label string
+			var encrypted bool
+			if err := scan(&id, &uuid, &userID, &label, &encrypted); err != nil {
+				return err
+			}
+			maxBookID = max(maxBookID, id)
+
+			if !m.sel.user(userID) || (encrypted && m.encrypted == EncryptedSkip) {
+				return nil
+			}
+			if users[userID] == nil {
+				stats.BooksWithoutUser++
+				orphan("books", id)
+				plan.drop("books", id)
+				return nil
+			}
+			users[userID].labels[label] = true
+			books[uuid] = true
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading books: %w", err)
+		}
+	}
+
+	// Notes are read in id order, which fixes the order of reparented notes
+	homeless := map[int][]int{}
+	lastUpdate := map[int]time.Time{}
+	if m.sel.table("notes") {
+		err := scanSource(ctx, m.src, "notes", []string{"id", "user_id", "book_uuid", "updated_at", "encrypted"}, func(scan func(...any) error) error {
+			var id, userID int
+			var bookUUID string
+			var updatedAt time.Time
+			var encrypted bool
+			if err := scan(&id, &userID, &bookUUID, &updatedAt, &encrypted); err != nil {
+				return err
+			}
+
+			if !m.sel.user(userID) || (encrypted && m.encrypted == EncryptedSkip) {
+				return nil
+			}
+			switch {
+			case users[userID] == nil:
+				stats.NotesWithoutUser++
+				orphan("notes", id)
+				plan.drop("notes", id)
+			case !books[bookUUID]:
+				stats.NotesWithoutBook++
+				orphan("notes", id)
+				switch m.orphans {
+				case OrphanDrop:
+					plan.drop("notes", id)
+				case OrphanReparent:
+					homeless[userID] = append(homeless[userID], id)
+					if updatedAt.After(lastUpdate[userID]) {
+						lastUpdate[userID] = updatedAt
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("reading notes: %w", err)
+		}
+	}
+
+	userIDs := make([]int, 0, len(homeless))
+	for userID := range homeless {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Ints(userIDs)
+
+	// Recovered books follow the source's books, one per user in id order,
+	// and get the next USNs of their user so that clients sync the change
+	for i, userID := range userIDs {
+		u := users[userID]
+		usn := u.maxUSN + 1
+
+		book := recoveredBook{
+			id:        maxBookID + i + 1,
+			uuid:      recoveredBookUUID(u.uuid),
+			userID:    userID,
+			label:     uniqueLabel(recoveredBookLabel, u.labels),
+			usn:       usn,
+			updatedAt: lastUpdate[userID],
+		}
+		plan.books = append(plan.books, book)
+
+		for _, noteID := range homeless[userID] {
+			usn++
+			plan.reparented[noteID] = reparentedNote{bookUUID: book.uuid, usn: usn}
+		}
+		plan.maxUSN[userID] = usn
+	}
+
+	for _, ids := range plan.dropped {
+		stats.Dropped += len(ids)
+	}
+	stats.Reparented = len(plan.reparented)
+	stats.RecoveredBooks = len(plan.books)
+
+	total := stats.Total()
+	if total == 0 {
+		return nil
+	}
+
+	if m.orphans == OrphanFail {
+		return fmt.Errorf("found %d rows that reference a missing user or book (%s): %s. Pass --orphans=drop to leave them out or --orphans=reparent to move notes without a book into a recovered book", total, stats.breakdown(), orphanIDs(found))
+	}
+	m.logf("Found %d rows that reference a missing user or book (%s)", total, stats.breakdown())
+
+	m.orphanPlan = plan
+	return nil
+}
+
+// breakdown lists the non-zero orphan counts by kind.
+func (s OrphanStats) breakdown() string {
+	kinds := []struct {
+		count int
+		name  string
+	}{
+		{s.BooksWithoutUser, "books without a user"},
+		{s.NotesWithoutUser, "notes without a user"},
+		{s.NotesWithoutBook, "notes without a book"},
+		{s.AccountsWithoutUser, "accounts without a user"},
+		{s.TokensWithoutUser, "tokens without a user"},
+		{s.SessionsWithoutUser, "sessions without a user"},
+	}
+
+	var parts string
+	for _, k := range kinds {
+		if k.count == 0 {
+			continue
+		}
+		if parts != "" {
+			parts += ", "
+		}
+		parts += fmt.Sprintf("%d %s", k.count, k.name)
+	}
+
+	return parts
+}
+
+// orphanIDs lists the ids of the orphans found in each table.
+func orphanIDs(found map[string]*idList) string {
+	var parts []string
+	for _, table := range []string{"accounts", "books", "notes", "tokens", "sessions"} {
+		if l := found[table]; l != nil {
+			parts = append(parts, fmt.Sprintf("%s ids %s", table, l))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// recoveredBookUUID derives the uuid of a user's recovered book from the
+// user's uuid, in the manner of a version 5 UUID, so that it is the same on
+// every run.
+func recoveredBookUUID(userUUID string) string {
+	h := sha1.Sum([]byte("dnote-pg2sqlite:recovered-book:" + userUUID))
+	h[6] = (h[6] & 0x0f) | 0x50
+	h[8] = (h[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+// insertRecoveredBooks writes the books that reparented notes are moved
+// into. It can run again on resume, as books already there are left alone.
+func (m *Migrator) insertRecoveredBooks(ctx context.Context) error {
+	if m.orphanPlan == nil || len(m.orphanPlan.books) == 0 {
+		return nil
+	}
+
+	tx, err := m.sqliteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, b := range m.orphanPlan.books {
+		if m.merge != nil {
+			b.usn = m.merge.usn(b.userID, b.usn)
+			b.userID = m.merge.user(b.userID)
+			b.label = m.merge.label(b.userID, b.uuid, b.label, false)
+			b.id = m.merge.id("books", b.id)
+		}
+
+		at := b.updatedAt.UnixNano()
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO books (id, created_at, updated_at, uuid, user_id, label, added_on, edited_on, usn, deleted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO NOTHING
+		`, b.id, b.updatedAt, b.updatedAt, b.uuid, b.userID, b.label, at, at, b.usn, false); err != nil {
+			return fmt.Errorf("inserting recovered book for user %d: %w", b.userID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// scanSource calls fn for every row of table, passing it a function that
+// scans the current row.
+func scanSource(ctx context.Context, src Source, table string, columns []string, fn func(scan func(...any) error) error) error {
+	rows, err := src.rows(ctx, table, columns, 0)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
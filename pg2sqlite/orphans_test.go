@@ -0,0 +1,165 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// orphanDump adds to testDump a book whose user does not exist, with a note
+// in it, a note of user 1 whose book does not exist, a note and a token of
+// the missing user, and a book of user 1 already labeled "Recovered".
+func orphanDump() string {
+	dump := strings.Replace(testDump,
+		"1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tf\n",
+		"1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tf\n"+
+			"2\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\tb0000000-0000-4000-8000-000000000002\t9\torphaned\t1704164645\t1704164645\t4\tf\tf\n"+
+			"3\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\tb0000000-0000-4000-8000-000000000003\t1\tRecovered\t1704164645\t1704164645\t5\tf\tf\n", 1)
+	dump = strings.Replace(dump, "\t'golang':1\tt\t2\tf\tf\tcli\n",
+		"\t'golang':1\tt\t2\tf\tf\tcli\n"+
+			"4\t2024-01-05 00:00:00+00\t2024-01-05 00:00:00+00\tn0000000-0000-4000-8000-000000000004\t1\tffffffff-0000-4000-8000-000000000000\tlost\t1704412800\t1704412800\t'lost':1\tf\t6\tf\tf\tcli\n"+
+			"5\t2024-01-06 00:00:00+00\t2024-01-06 00:00:00+00\tn0000000-0000-4000-8000-000000000005\t1\tb0000000-0000-4000-8000-000000000002\tmoved\t1704499200\t1704499200\t'moved':1\tf\t7\tf\tf\tcli\n"+
+			"6\t2024-01-06 00:00:00+00\t2024-01-06 00:00:00+00\tn0000000-0000-4000-8000-000000000006\t9\tb0000000-0000-4000-8000-000000000002\tnobody\t1704499200\t1704499200\t'nobody':1\tf\t8\tf\tf\tcli\n", 1)
+	dump = strings.Replace(dump, "1\ttoken123\taccess\t\\N\n",
+		"1\ttoken123\taccess\t\\N\n"+
+			"2\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t9\ttoken456\taccess\t\\N\n", 1)
+
+	return dump
+}
+
+func runOrphanMigration(t *testing.T, policy OrphanPolicy) (*sql.DB, *Result, error) {
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, orphanDump()))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	result, err := New(src, db, Options{BatchSize: 2, Orphans: policy}).Run(context.Background())
+	return db, result, err
+}
+
+func TestOrphansDrop(t *testing.T) {
+	db, result, err := runOrphanMigration(t, OrphanDrop)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := OrphanStats{BooksWithoutUser: 1, NotesWithoutUser: 1, NotesWithoutBook: 2, TokensWithoutUser: 1, Dropped: 5}
+	if result.Stats.Orphans != expected {
+		t.Errorf("Orphans: expected %+v, got %+v", expected, result.Stats.Orphans)
+	}
+	if result.Stats.Books != 2 || result.Stats.Notes != 2 || result.Stats.Tokens != 1 {
+		t.Errorf("Expected 2 books, 2 notes and 1 token, got %+v", result.Stats)
+	}
+	expectedSkipped := []SkippedRow{
+		{Table: "books", ID: 2, Reason: SkipOrphan},
+		{Table: "tokens", ID: 2, Reason: SkipOrphan},
+		{Table: "notes", ID: 4, Reason: SkipOrphan},
+		{Table: "notes", ID: 5, Reason: SkipOrphan},
+		{Table: "notes", ID: 6, Reason: SkipOrphan},
+	}
+	if fmt.Sprint(result.Skipped) != fmt.Sprint(expectedSkipped) {
+		t.Errorf("Skipped: expected %v, got %v", expectedSkipped, result.Skipped)
+	}
+
+	var notes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notes WHERE id > 3").Scan(&notes); err != nil {
+		t.Fatalf("Failed to count notes: %v", err)
+	}
+	if notes != 0 {
+		t.Errorf("Expected the orphaned notes to be dropped, found %d", notes)
+	}
+}
+
+func TestOrphansReparent(t *testing.T) {
+	db, result, err := runOrphanMigration(t, OrphanReparent)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := OrphanStats{BooksWithoutUser: 1, NotesWithoutUser: 1, NotesWithoutBook: 2, TokensWithoutUser: 1, Dropped: 3, Reparented: 2, RecoveredBooks: 1}
+	if result.Stats.Orphans != expected {
+		t.Errorf("Orphans: expected %+v, got %+v", expected, result.Stats.Orphans)
+	}
+
+	// The recovered book follows the source's books and avoids the existing
+	// "Recovered" label
+	var id, userID, usn int
+	var uuid, label string
+	if err := db.QueryRow("SELECT id, uuid, user_id, label, usn FROM books WHERE label LIKE 'Recovered (%'").Scan(&id, &uuid, &userID, &label, &usn); err != nil {
+		t.Fatalf("Failed to find the recovered book: %v", err)
+	}
+	if id != 4 || userID != 1 || label != "Recovered (2)" || usn != 11 {
+		t.Errorf("Recovered book: got id %d, user %d, label %q, usn %d", id, userID, label, usn)
+	}
+	if uuid != recoveredBookUUID("7c9e6679-7425-40de-944b-e07fc1f90ae7") {
+		t.Errorf("Recovered book: unexpected uuid %s", uuid)
+	}
+
+	rows, err := db.Query("SELECT id, book_uuid, usn FROM notes WHERE id IN (4, 5, 6) ORDER BY id")
+	if err != nil {
+		t.Fatalf("Failed to query notes: %v", err)
+	}
+	defer rows.Close()
+
+	moved := 0
+	for rows.Next() {
+		var noteID, noteUSN int
+		var bookUUID string
+		if err := rows.Scan(&noteID, &bookUUID, &noteUSN); err != nil {
+			t.Fatalf("Failed to scan note: %v", err)
+		}
+		if bookUUID != uuid {
+			t.Errorf("Note %d: expected book %s, got %s", noteID, uuid, bookUUID)
+		}
+		moved++
+		if noteUSN != usn+moved {
+			t.Errorf("Note %d: expected usn %d, got %d", noteID, usn+moved, noteUSN)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Failed to read notes: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("Expected notes 4 and 5 to be moved and note 6 dropped, got %d notes", moved)
+	}
+
+	var maxUSN int
+	if err := db.QueryRow("SELECT max_usn FROM users WHERE id = 1").Scan(&maxUSN); err != nil {
+		t.Fatalf("Failed to read max_usn: %v", err)
+	}
+	if maxUSN != 13 {
+		t.Errorf("max_usn: expected 13, got %d", maxUSN)
+	}
+}
+
+func TestOrphansFail(t *testing.T) {
+	db, _, err := runOrphanMigration(t, OrphanFail)
+	if err == nil || !strings.Contains(err.Error(), "found 5 rows that reference a missing user or book") ||
+		!strings.Contains(err.Error(), "books ids 2, notes ids 4, 5, 6, tokens ids 2") {
+		t.Fatalf("Expected the orphans to be refused by id, got %v", err)
+	}
+
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&tables); err != nil {
+		t.Fatalf("Failed to query schema: %v", err)
+	}
+	if tables != 0 {
+		t.Errorf("Expected nothing to be written, found %d schema objects", tables)
+	}
+}
+
+func TestParseOrphanPolicyKeep(t *testing.T) {
+	if _, err := ParseOrphanPolicy("keep"); err == nil || !strings.Contains(err.Error(), "has been removed") {
+		t.Errorf("Expected keep to be reported as removed, got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package pg2sqlite
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// nullableColumns are the source columns in which the migration accepts
+// NULLs. A NULL in any other column makes the copy fail.
+var nullableColumns = map[string][]string{
+	"users":    {"last_login_at"},
+	"accounts": {"email", "password"},
+	"tokens":   {"used_at"},
+}
+
+// uniqueColumns are the source columns whose values must be unique in the
+// target schema.
+var uniqueColumns = map[string][]string{
+	"users": {"uuid"},
+	"books": {"uuid"},
+	"notes": {"uuid"},
+}
+
+// maxListedIDs caps the number of row ids quoted in a single problem.
+const maxListedIDs = 10
+
+// PlannedTable is the data a migration would read from one table.
+type PlannedTable struct {
+	Name  string
+	Rows  int
+	Bytes int64
+}
+
+// PlanProblem is something in the source that the migration would trip
+// over, or that the operator should know about before running it.
+type PlanProblem struct {
+	Table   string
+	Message string
+	// Blocking problems make the real migration fail
+	Blocking bool
+}
+
+// MigrationPlan is what Plan found in the source.
+type MigrationPlan struct {
+	Tables   []PlannedTable
+	Problems []PlanProblem
+}
+
+// idList collects the ids of the rows affected by one kind of problem.
+type idList struct {
+	count int
+	ids   []int
+}
+
+func (l *idList) add(id int) {
+	l.count++
+	if len(l.ids) < maxListedIDs {
+		l.ids = append(l.ids, id)
+	}
+}
+
+func (l *idList) String() string {
+	ids := make([]string, len(l.ids))
+	for i, id := range l.ids {
+		ids[i] = fmt.Sprint(id)
+	}
+
+	s := strings.Join(ids, ", ")
+	if l.count > len(l.ids) {
+		s += ", ..."
+	}
+
+	return s
+}
+
+// Plan reads every row the migration would copy, without writing anything,
+// and collects row counts, data sizes and the problems Run would run into.
+// Unlike Check, it reports encrypted rows as a problem instead of failing.
+func (m *Migrator) Plan(ctx context.Context) (*MigrationPlan, error) {
+	m.logf("Checking source schema...")
+	report, err := checkSchema(ctx, m.src)
+	if err != nil {
+		return nil, err
+	}
+	m.logf("Detected %s", report)
+
+	sel, err := resolveFilter(ctx, m.src, m.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m.logf("Reading source data...")
+	return planMigration(ctx, m.src, m.encrypted, m.orphans, sel)
+}
+
+// planMigration does the work of Plan, for the tables and users in sel.
+func planMigration(ctx context.Context, src Source, encrypted EncryptedPolicy, orphans OrphanPolicy, sel *selection) (*MigrationPlan, error) {
+	var plan MigrationPlan
+
+	userIDs := map[int]bool{}
+	bookUUIDs := map[string]bool{}
+
+	for _, table := range tableOrder {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !sel.table(table) {
+			continue
+		}
+
+		columns := sourceColumns[table]
+		nulls := make([]idList, len(columns))
+		duplicates := map[string]*idList{}
+		seen := map[string]map[string]bool{}
+		for _, c := range uniqueColumns[table] {
+			seen[c] = map[string]bool{}
+			duplicates[c] = &idList{}
+		}
+		var missingUsers, missingBooks, encryptedRows, verifiedRows idList
+
+		rows, err := src.rows(ctx, table, columns, 0)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", table, err)
+		}
+
+		pt := PlannedTable{Name: table}
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("reading %s: %w", table, err)
+			}
+
+			row := map[string]string{}
+			for i, c := range columns {
+				row[c] = normalizeValue(values[i])
+			}
+			id, _ := strconv.Atoi(row["id"])
+
+			owner := id
+			if table != "users" {
+				owner, _ = strconv.Atoi(row["user_id"])
+			}
+			if !sel.user(owner) {
+				continue
+			}
+
+			for i, c := range columns {
+				pt.Bytes += int64(len(row[c]))
+				if values[i] == nil && !slices.Contains(nullableColumns[table], c) {
+					nulls[i].add(id)
+				}
+			}
+			pt.Rows++
+
+			for _, c := range uniqueColumns[table] {
+				if values[slices.Index(columns, c)] == nil {
+					continue
+				}
+				if seen[c][row[c]] {
+					duplicates[c].add(id)
+				}
+				seen[c][row[c]] = true
+			}
+
+			// Rows skipped as encrypted are not written, so like in
+			// migrateBooks and migrateNotes, a skipped book leaves its notes
+			// without a book and a skipped note is no orphan
+			skipped := false
+			if v, ok := row["encrypted"]; ok && (v == "1" || v == "t") {
+				encryptedRows.add(id)
+				skipped = encrypted == EncryptedSkip
+			}
+			if skipped {
+				continue
+			}
+
+			switch table {
+			case "users":
+				userIDs[id] = true
+			case "books":
+				bookUUIDs[row["uuid"]] = true
+			}
+			if userID, ok := row["user_id"]; ok {
+				if uid, _ := strconv.Atoi(userID); !userIDs[uid] {
+					missingUsers.add(id)
+				}
+			}
+			if bookUUID, ok := row["book_uuid"]; ok && !bookUUIDs[bookUUID] {
+				missingBooks.add(id)
+			}
+			if v, ok := row["email_verified"]; ok && (v == "1" || v == "t") {
+				verifiedRows.add(id)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("reading %s: %w", table, err)
+		}
+		rows.Close()
+
+		plan.Tables = append(plan.Tables, pt)
+
+		problem := func(l *idList, blocking bool, format string, args ...any) {
+			if l.count == 0 {
+				return
+			}
+			msg := fmt.Sprintf(format, args...)
+			plan.Problems = append(plan.Problems, PlanProblem{
+				Table:    table,
+				Message:  fmt.Sprintf("%d rows %s (ids %s)", l.count, msg, l),
+				Blocking: blocking,
+			})
+		}
+
+		for i, c := range columns {
+			problem(&nulls[i], true, "have NULL in %s, which cannot be NULL in the target", c)
+		}
+		for _, c := range uniqueColumns[table] {
+			problem(duplicates[c], true, "repeat an earlier %s", c)
+		}
+		problem(&missingUsers, orphans == OrphanFail, "reference a user that does not exist and would be %s under --orphans=%s",
+			map[OrphanPolicy]string{OrphanDrop: "dropped", OrphanReparent: "dropped", OrphanFail: "refused"}[orphans], orphans)
+		problem(&missingBooks, orphans == OrphanFail, "reference a book that does not exist and would be %s under --orphans=%s",
+			map[OrphanPolicy]string{OrphanDrop: "dropped", OrphanReparent: "moved to a recovered book", OrphanFail: "refused"}[orphans], orphans)
+		problem(&verifiedRows, false, "have a verified email, which the v3 schema does not record, and would come out unverified")
+		problem(&encryptedRows, encrypted == EncryptedFail, "are encrypted and would be %s under --encrypted=%s",
+			map[EncryptedPolicy]string{EncryptedSkip: "skipped", EncryptedKeep: "migrated as ciphertext", EncryptedFail: "refused"}[encrypted], encrypted)
+	}
+
+	return &plan, nil
+}
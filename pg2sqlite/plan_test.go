@@ -0,0 +1,94 @@
+package pg2sqlite
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanMigration(t *testing.T) {
+	// Note 3 points at a book that does not exist, a second book repeats the
+	// uuid of book 1 and the token has no value.
+	dump := strings.Replace(testDump,
+		"1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tf\n",
+		"1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tf\n"+
+			"2\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\trust\t1704164645\t1704164645\t4\tf\tf\n", 1)
+	dump = strings.Replace(dump,
+		"1\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\tsecond",
+		"1\t00000000-0000-4000-8000-000000000000\tsecond", 1)
+	dump = strings.Replace(dump, "1\ttoken123\taccess", "1\t\\N\taccess", 1)
+
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, dump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	plan, err := New(src, nil, Options{}).Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to plan migration: %v", err)
+	}
+
+	rows := map[string]int{}
+	for _, pt := range plan.Tables {
+		rows[pt.Name] = pt.Rows
+		if pt.Rows > 0 && pt.Bytes == 0 {
+			t.Errorf("Expected a data size for %s", pt.Name)
+		}
+	}
+	expectedRows := map[string]int{"users": 2, "accounts": 2, "books": 2, "notes": 2, "tokens": 1, "sessions": 1}
+	for table, n := range expectedRows {
+		if rows[table] != n {
+			t.Errorf("Expected %d %s, got %d", n, table, rows[table])
+		}
+	}
+
+	expectedProblems := []PlanProblem{
+		{Table: "accounts", Message: "1 rows have a verified email, which the v3 schema does not record, and would come out unverified (ids 1)"},
+		{Table: "books", Message: "1 rows repeat an earlier uuid (ids 2)", Blocking: true},
+		{Table: "notes", Message: "1 rows reference a book that does not exist and would be refused under --orphans=fail (ids 3)", Blocking: true},
+		{Table: "tokens", Message: "1 rows have NULL in value, which cannot be NULL in the target (ids 1)", Blocking: true},
+	}
+	if len(plan.Problems) != len(expectedProblems) {
+		t.Fatalf("Expected %d problems, got %+v", len(expectedProblems), plan.Problems)
+	}
+	for i, p := range expectedProblems {
+		if plan.Problems[i] != p {
+			t.Errorf("Problem %d: expected %+v, got %+v", i, p, plan.Problems[i])
+		}
+	}
+}
+
+func TestPlanSkippedEncryptedBook(t *testing.T) {
+	// Book 1 is encrypted, so skipping it leaves both notes without a book
+	dump := strings.Replace(testDump,
+		"\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tf\n",
+		"\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\tf\tt\n", 1)
+	opts := Options{Encrypted: EncryptedSkip, Orphans: OrphanDrop}
+
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, dump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	plan, err := New(src, nil, opts).Plan(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to plan migration: %v", err)
+	}
+
+	expected := PlanProblem{Table: "notes", Message: "2 rows reference a book that does not exist and would be dropped under --orphans=drop (ids 1, 3)"}
+	if !slices.Contains(plan.Problems, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, plan.Problems)
+	}
+
+	// Run drops the same notes
+	_, result, err := runFilteredMigration(t, dump, opts)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stats.Orphans.NotesWithoutBook != 2 {
+		t.Errorf("Expected Run to find 2 notes without a book, got %+v", result.Stats.Orphans)
+	}
+}
@@ -0,0 +1,82 @@
+package pg2sqlite
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Progress describes how far the copy of a table has got. Read, Total and
+// Bytes only cover the current run, so a resumed table starts again from
+// zero.
+type Progress struct {
+	Table string
+	// Rows is the number of rows written to Table so far
+	Rows int
+	// Read is the number of source rows read, out of Total
+	Read  int
+	Total int
+	// Bytes is the approximate size of the values read
+	Bytes   int64
+	Elapsed time.Duration
+	Done    bool
+}
+
+// Rate is the number of rows read per second.
+func (p Progress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(p.Read) / p.Elapsed.Seconds()
+}
+
+// ETA estimates the time left to read the rest of the table at the current
+// rate, or returns 0 if there is no rate yet.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if rate == 0 || p.Read >= p.Total {
+		return 0
+	}
+
+	return time.Duration(float64(p.Total-p.Read) / rate * float64(time.Second))
+}
+
+// measuringRows adds up the size of every value scanned from the rows it
+// wraps.
+type measuringRows struct {
+	sourceRows
+	bytes int64
+}
+
+func (r *measuringRows) Scan(dest ...any) error {
+	if err := r.sourceRows.Scan(dest...); err != nil {
+		return err
+	}
+
+	for _, d := range dest {
+		r.bytes += valueSize(d)
+	}
+
+	return nil
+}
+
+// valueSize approximates the size of a scanned value: the length of text,
+// and the storage size of everything else.
+func valueSize(dest any) int64 {
+	switch v := dest.(type) {
+	case *string:
+		return int64(len(*v))
+	case *sql.NullString:
+		return int64(len(v.String))
+	case *NullString:
+		return int64(len(v.String))
+	case *[]byte:
+		return int64(len(*v))
+	case *bool:
+		return 1
+	case *int, *int64, *time.Time, *sql.NullTime:
+		return 8
+	}
+
+	return 0
+}
@@ -0,0 +1,270 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// readAheadBatches is the number of batches a table's reader may get ahead
+// of the writer.
+const readAheadBatches = 2
+
+// readAhead reads the tables of a migration on up to Options.Workers
+// goroutines, while a single writer copies them into SQLite one after the
+// other. Readers start in the order the tables are written and each keeps
+// at most readAheadBatches batches waiting, so the table being written is
+// always being read, and the target ends up the same as with one worker.
+//
+// What it saves is therefore the time spent reading the table being written,
+// up to the time spent writing it. notes, usually by far the largest table,
+// is still read by one reader, and the readers of the tables after it stop
+// two batches in, so workers past 2 gain little. The scans Check makes for
+// encrypted and orphaned rows are not read ahead either.
+// BenchmarkMigratorRunWorkers measures this.
+type readAhead struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	tables map[string]<-chan rowChunk
+}
+
+// rowChunk is a batch of rows, as scanned into *any, or the error that
+// ended a table's rows.
+type rowChunk struct {
+	rows [][]any
+	err  error
+}
+
+// startReadAhead starts reading the tables run is about to copy, after
+// their checkpoints.
+func (m *Migrator) startReadAhead(ctx context.Context) (*readAhead, error) {
+	type tableRead struct {
+		name    string
+		afterID int
+		ch      chan rowChunk
+	}
+
+	var reads []tableRead
+	for _, t := range m.tableCopies() {
+		if !m.sel.table(t.name) {
+			continue
+		}
+
+		cp, err := loadCheckpoint(ctx, m.sqliteDB, t.name)
+		if err != nil {
+			return nil, fmt.Errorf("loading checkpoint for %s: %w", t.name, err)
+		}
+		if !cp.Done {
+			reads = append(reads, tableRead{t.name, cp.LastID, make(chan rowChunk, readAheadBatches)})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	a := &readAhead{ctx: ctx, cancel: cancel, tables: map[string]<-chan rowChunk{}}
+	for _, r := range reads {
+		a.tables[r.name] = r.ch
+	}
+
+	// A reader takes a slot when it starts and gives it back once it has
+	// handed over its last rows
+	slots := make(chan struct{}, m.workers)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		for _, r := range reads {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			a.wg.Add(1)
+			go func() {
+				defer a.wg.Done()
+				defer func() { <-slots }()
+
+				m.readTable(ctx, r.name, r.afterID, r.ch)
+			}()
+		}
+	}()
+
+	return a, nil
+}
+
+// readTable sends the rows of table after afterID to ch in batches, and
+// closes it.
+func (m *Migrator) readTable(ctx context.Context, table string, afterID int, ch chan<- rowChunk) {
+	defer close(ch)
+
+	send := func(c rowChunk) bool {
+		select {
+		case ch <- c:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	rows, err := m.src.rows(ctx, table, sourceColumns[table], afterID)
+	if err != nil {
+		send(rowChunk{err: err})
+		return
+	}
+	defer rows.Close()
+
+	numColumns := len(sourceColumns[table])
+	var c rowChunk
+	for rows.Next() {
+		values := make([]any, numColumns)
+		dest := make([]any, numColumns)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			c.err = err
+			send(c)
+			return
+		}
+
+		c.rows = append(c.rows, values)
+		if len(c.rows) == m.batchSize {
+			if !send(c) {
+				return
+			}
+			c = rowChunk{}
+		}
+	}
+
+	c.err = rows.Err()
+	send(c)
+}
+
+// rows returns the rows read ahead for table, or nil if a is nil or does not
+// read table. Each table's rows can only be taken once.
+func (a *readAhead) rows(table string) sourceRows {
+	if a == nil {
+		return nil
+	}
+
+	ch, ok := a.tables[table]
+	if !ok {
+		return nil
+	}
+	delete(a.tables, table)
+
+	return &readAheadRows{ctx: a.ctx, ch: ch}
+}
+
+// stop stops the readers and waits for them to return.
+func (a *readAhead) stop() {
+	a.cancel()
+	a.wg.Wait()
+}
+
+// readAheadRows serves the rows a reader sent, in order.
+type readAheadRows struct {
+	ctx  context.Context
+	ch   <-chan rowChunk
+	rows [][]any
+	row  []any
+	err  error
+}
+
+func (r *readAheadRows) Next() bool {
+	for len(r.rows) == 0 {
+		if r.err != nil {
+			return false
+		}
+
+		select {
+		case c, ok := <-r.ch:
+			if !ok {
+				return false
+			}
+			r.rows, r.err = c.rows, c.err
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			return false
+		}
+	}
+
+	r.row, r.rows = r.rows[0], r.rows[1:]
+	return true
+}
+
+func (r *readAheadRows) Scan(dest ...any) error {
+	if len(dest) != len(r.row) {
+		return fmt.Errorf("expected %d destination arguments in Scan, not %d", len(r.row), len(dest))
+	}
+
+	for i, d := range dest {
+		if err := scanValue(r.row[i], d); err != nil {
+			return fmt.Errorf("converting column %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *readAheadRows) Err() error {
+	return r.err
+}
+
+// Close leaves the source rows to the reader, which stops when the readers
+// are stopped.
+func (r *readAheadRows) Close() error {
+	return nil
+}
+
+// scanValue stores v, a value scanned into an *any, in dest. Text and NULL
+// are converted the way the rows of a dump are, and the values of the
+// Postgres driver the way database/sql would.
+func scanValue(v, dest any) error {
+	switch v := v.(type) {
+	case nil:
+		return scanCopyValue(nil, dest)
+	case string:
+		return scanCopyValue(&v, dest)
+	}
+
+	if s, ok := dest.(sql.Scanner); ok {
+		return s.Scan(v)
+	}
+
+	switch d := dest.(type) {
+	case *any:
+		*d = v
+		return nil
+	case *int:
+		if n, ok := v.(int64); ok {
+			*d = int(n)
+			return nil
+		}
+	case *int64:
+		if n, ok := v.(int64); ok {
+			*d = n
+			return nil
+		}
+	case *bool:
+		if b, ok := v.(bool); ok {
+			*d = b
+			return nil
+		}
+	case *time.Time:
+		if t, ok := v.(time.Time); ok {
+			*d = t
+			return nil
+		}
+	case *string:
+		if b, ok := v.([]byte); ok {
+			*d = string(b)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("cannot store %T in %T", v, dest)
+}
@@ -0,0 +1,175 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMigratorRunWorkers(t *testing.T) {
+	run := func(workers int) (*sql.DB, *Result) {
+		src, err := OpenDumpSource(context.Background(), writeTestDump(t, testDump))
+		if err != nil {
+			t.Fatalf("Failed to open dump: %v", err)
+		}
+		defer src.Close()
+
+		db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), fmt.Sprintf("workers-%d.db", workers)))
+		if err != nil {
+			t.Fatalf("Failed to open SQLite: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		result, err := New(src, db, Options{BatchSize: 1, Workers: workers}).Run(context.Background())
+		if err != nil {
+			t.Fatalf("Run with %d workers failed: %v", workers, err)
+		}
+
+		return db, result
+	}
+
+	tables := func(result *Result) string {
+		var s string
+		for _, ts := range result.Tables {
+			s += fmt.Sprintf("%s %d %d %d %d; ", ts.Name, ts.Read, ts.Written, ts.Skipped, ts.Filtered)
+		}
+		return s
+	}
+
+	expectedDB, expected := run(1)
+	for _, workers := range []int{2, 6} {
+		db, result := run(workers)
+
+		if result.Stats != expected.Stats {
+			t.Errorf("%d workers: expected stats %+v, got %+v", workers, expected.Stats, result.Stats)
+		}
+		if tables(result) != tables(expected) {
+			t.Errorf("%d workers: expected tables %s, got %s", workers, tables(expected), tables(result))
+		}
+
+		report, err := Verify(context.Background(), expectedDB, db)
+		if err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		if !report.OK {
+			t.Errorf("%d workers: target differs from one worker's: %+v", workers, report.Tables)
+		}
+	}
+}
+
+func TestScanValue(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Values as the Postgres driver returns them
+	var id int
+	var addedOn int64
+	var createdAt time.Time
+	var uuid, label string
+	var deleted bool
+	var lastLoginAt sql.NullTime
+	var password sql.NullString
+	dest := []any{&id, &addedOn, &createdAt, &uuid, &label, &deleted, &lastLoginAt, &password}
+	values := []any{int64(7), int64(1704164645), now, []byte("2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b"), "golang", true, nil, "secret"}
+
+	for i := range dest {
+		if err := scanValue(values[i], dest[i]); err != nil {
+			t.Fatalf("column %d: %v", i, err)
+		}
+	}
+	if id != 7 || addedOn != 1704164645 || !createdAt.Equal(now) || uuid != "2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b" || label != "golang" || !deleted {
+		t.Errorf("unexpected values: %v %v %v %v %v %v", id, addedOn, createdAt, uuid, label, deleted)
+	}
+	if lastLoginAt.Valid || password != (sql.NullString{String: "secret", Valid: true}) {
+		t.Errorf("unexpected nullable values: %+v %+v", lastLoginAt, password)
+	}
+
+	if err := scanValue(nil, &id); err == nil {
+		t.Error("expected NULL in a NOT NULL column to fail")
+	}
+	if err := scanValue(true, &id); err == nil {
+		t.Error("expected a bool to be rejected for an int")
+	}
+}
+
+// slowSource delays the rows of its Source by delay every batchSize rows,
+// the way the round trip of each fetch from a remote Postgres server does.
+type slowSource struct {
+	Source
+	delay     time.Duration
+	batchSize int
+}
+
+func (s slowSource) rows(ctx context.Context, table string, columns []string, afterID int) (sourceRows, error) {
+	rows, err := s.Source.rows(ctx, table, columns, afterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowRows{sourceRows: rows, source: s}, nil
+}
+
+type slowRows struct {
+	sourceRows
+	source slowSource
+	read   int
+}
+
+func (r *slowRows) Next() bool {
+	if r.read%r.source.batchSize == 0 {
+		time.Sleep(r.source.delay)
+	}
+	r.read++
+
+	return r.sourceRows.Next()
+}
+
+// BenchmarkMigratorRunWorkers compares reading ahead with several workers to
+// reading each table as it is written, from a source that is slower to read
+// than SQLite is to write.
+func BenchmarkMigratorRunWorkers(b *testing.B) {
+	const notes = 5000
+	const batchSize = 100
+
+	var rows strings.Builder
+	for id := 100; id < 100+notes; id++ {
+		fmt.Fprintf(&rows, "%d\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t%08x-0000-4000-8000-000000000000\t1\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\tnote %d\t1704164645\t1704164645\t'note':1\tf\t1\tf\tf\tcli\n", id, id, id)
+	}
+	header := "COPY public.notes (id, created_at, updated_at, uuid, user_id, book_uuid, body, added_on, edited_on, tsv, public, usn, deleted, encrypted, client) FROM stdin;\n"
+	dumpPath := filepath.Join(b.TempDir(), "dump.sql")
+	if err := os.WriteFile(dumpPath, []byte(strings.Replace(testDump, header, header+rows.String(), 1)), 0644); err != nil {
+		b.Fatalf("Failed to write dump: %v", err)
+	}
+
+	for _, workers := range []int{1, 2, 6} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				src, err := OpenDumpSource(context.Background(), dumpPath)
+				if err != nil {
+					b.Fatalf("Failed to open dump: %v", err)
+				}
+				db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), fmt.Sprintf("bench-%d.db", i))+"?"+SQLiteLoadParams)
+				if err != nil {
+					b.Fatalf("Failed to open SQLite: %v", err)
+				}
+				db.SetMaxOpenConns(1)
+				m := New(slowSource{Source: src, delay: 5 * time.Millisecond, batchSize: batchSize}, db, Options{BatchSize: batchSize, Workers: workers})
+				b.StartTimer()
+
+				if _, err := m.Run(context.Background()); err != nil {
+					b.Fatalf("Run failed: %v", err)
+				}
+
+				b.StopTimer()
+				db.Close()
+				src.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package pg2sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// v2Columns lists every column of the Dnote server v2.x schema, including
+// the ones that are read but not carried over, such as notes.tsv.
+var v2Columns = map[string][]string{
+	"users":    {"id", "created_at", "updated_at", "uuid", "last_login_at", "max_usn", "cloud"},
+	"accounts": {"id", "created_at", "updated_at", "user_id", "email", "email_verified", "password"},
+	"books":    {"id", "created_at", "updated_at", "uuid", "user_id", "label", "added_on", "edited_on", "usn", "deleted", "encrypted"},
+	"notes":    {"id", "created_at", "updated_at", "uuid", "user_id", "book_uuid", "body", "added_on", "edited_on", "tsv", "public", "usn", "deleted", "encrypted", "client"},
+	"tokens":   {"id", "created_at", "updated_at", "user_id", "value", "type", "used_at"},
+	"sessions": {"id", "created_at", "updated_at", "user_id", "key", "last_used_at", "expires_at"},
+}
+
+// tableOrder is the order in which tables are inspected and reported.
+var tableOrder = []string{"users", "accounts", "books", "notes", "tokens", "sessions"}
+
+// migrationsTable is where Dnote server records the schema migrations it has
+// applied.
+const migrationsTable = "migrations"
+
+const (
+	schemaVersionV2      = "v2.x"
+	schemaVersionPreV2   = "older than v2"
+	schemaVersionUnknown = "unknown"
+)
+
+// SchemaReport describes the source schema found by the preflight check.
+type SchemaReport struct {
+	Version    string
+	Migrations []string
+	Tables     []TableSchema
+	// ServerVersion is the version of the source Postgres server, if known
+	ServerVersion string
+	// Fingerprint is a hash of the tables and columns of the source, which
+	// tells apart databases whose schema drifted from the release
+	Fingerprint string
+}
+
+type TableSchema struct {
+	Name    string
+	Exists  bool
+	Columns []string
+	Missing []string
+	Extra   []string
+}
+
+// supported reports whether every column the migration reads is present.
+func (r *SchemaReport) supported() bool {
+	return r.Version == schemaVersionV2
+}
+
+func (r *SchemaReport) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Dnote server %s", r.Version)
+	if n := len(r.Migrations); n > 0 {
+		fmt.Fprintf(&b, " (%d migrations applied, latest %s)", n, r.Migrations[n-1])
+	}
+
+	for _, t := range r.Tables {
+		switch {
+		case !t.Exists:
+			fmt.Fprintf(&b, "\n  %s: table is missing", t.Name)
+		case len(t.Missing) > 0 || len(t.Extra) > 0:
+			fmt.Fprintf(&b, "\n  %s:", t.Name)
+			if len(t.Missing) > 0 {
+				fmt.Fprintf(&b, " missing columns %s", strings.Join(t.Missing, ", "))
+			}
+			if len(t.Extra) > 0 {
+				if len(t.Missing) > 0 {
+					b.WriteString(";")
+				}
+				fmt.Fprintf(&b, " unexpected columns %s", strings.Join(t.Extra, ", "))
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// preflight inspects the source schema and identifies which Dnote server
+// version it belongs to, so that an unsupported database is rejected with an
+// explanation instead of failing halfway through with a query error.
+func preflight(ctx context.Context, src Source) (*SchemaReport, error) {
+	report := SchemaReport{}
+
+	migrations, err := src.appliedMigrations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+	report.Migrations = migrations
+
+	if report.ServerVersion, err = src.serverVersion(ctx); err != nil {
+		return nil, fmt.Errorf("reading server version: %w", err)
+	}
+
+	missingTables, missingColumns := 0, 0
+	for _, name := range tableOrder {
+		columns, err := src.tableColumns(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("reading columns of %s: %w", name, err)
+		}
+
+		t := TableSchema{Name: name, Exists: columns != nil, Columns: columns}
+		if !t.Exists {
+			missingTables++
+		}
+
+		if t.Exists {
+			for _, c := range sourceColumns[name] {
+				if !slices.Contains(columns, c) {
+					t.Missing = append(t.Missing, c)
+				}
+			}
+			for _, c := range columns {
+				if !slices.Contains(v2Columns[name], c) {
+					t.Extra = append(t.Extra, c)
+				}
+			}
+		}
+		missingColumns += len(t.Missing)
+
+		report.Tables = append(report.Tables, t)
+	}
+
+	report.Fingerprint = schemaFingerprint(report.Tables)
+
+	switch {
+	case missingTables == len(tableOrder):
+		report.Version = schemaVersionUnknown
+	case missingTables > 0 || missingColumns > 0:
+		report.Version = schemaVersionPreV2
+	default:
+		report.Version = schemaVersionV2
+	}
+
+	return &report, nil
+}
+
+// schemaFingerprint hashes the columns of every table, in the order the
+// source lists them.
+func schemaFingerprint(tables []TableSchema) string {
+	h := sha256.New()
+	for _, t := range tables {
+		fmt.Fprintf(h, "%s(%s)\n", t.Name, strings.Join(t.Columns, ", "))
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// checkSchema runs preflight and returns an error with upgrade instructions
+// if the source cannot be migrated.
+func checkSchema(ctx context.Context, src Source) (*SchemaReport, error) {
+	report, err := preflight(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if !report.supported() {
+		instructions := "Upgrade to Dnote server v2.x and start it once so that it applies its database migrations, then run this tool again."
+		if report.Version == schemaVersionUnknown {
+			instructions = "Check that the connection settings point at your Dnote database."
+		}
+
+		return nil, fmt.Errorf("unsupported source schema: %s\n%s", report, instructions)
+	}
+
+	return report, nil
+}
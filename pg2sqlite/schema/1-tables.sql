@@ -0,0 +1,87 @@
+CREATE TABLE IF NOT EXISTS users (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	uuid text NOT NULL,
+	last_login_at datetime,
+	max_usn integer NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_uuid ON users(uuid);
+
+CREATE TABLE IF NOT EXISTS accounts (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	user_id integer NOT NULL,
+	email text,
+	password text,
+	CONSTRAINT fk_users_account FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_accounts_user_id ON accounts(user_id);
+
+CREATE TABLE IF NOT EXISTS books (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	uuid text NOT NULL,
+	user_id integer NOT NULL,
+	label text NOT NULL,
+	added_on integer NOT NULL,
+	edited_on integer NOT NULL,
+	usn integer NOT NULL,
+	deleted numeric NOT NULL DEFAULT false,
+	CONSTRAINT fk_users_books FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_books_uuid ON books(uuid);
+CREATE INDEX IF NOT EXISTS idx_books_user_id ON books(user_id);
+CREATE INDEX IF NOT EXISTS idx_books_label ON books(label);
+CREATE INDEX IF NOT EXISTS idx_books_usn ON books(usn);
+
+CREATE TABLE IF NOT EXISTS notes (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	uuid text NOT NULL,
+	user_id integer NOT NULL,
+	book_uuid text NOT NULL,
+	body text NOT NULL,
+	added_on integer NOT NULL,
+	edited_on integer NOT NULL,
+	public numeric NOT NULL DEFAULT false,
+	usn integer NOT NULL,
+	deleted numeric NOT NULL DEFAULT false,
+	client text NOT NULL,
+	CONSTRAINT fk_books_notes FOREIGN KEY (book_uuid) REFERENCES books(uuid),
+	CONSTRAINT fk_users_notes FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_uuid ON notes(uuid);
+CREATE INDEX IF NOT EXISTS idx_notes_user_id ON notes(user_id);
+CREATE INDEX IF NOT EXISTS idx_notes_book_uuid ON notes(book_uuid);
+CREATE INDEX IF NOT EXISTS idx_notes_usn ON notes(usn);
+CREATE INDEX IF NOT EXISTS idx_notes_client ON notes(client);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	user_id integer NOT NULL,
+	value text NOT NULL,
+	type text NOT NULL,
+	used_at datetime,
+	CONSTRAINT fk_users_tokens FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id ON tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_tokens_value ON tokens(value);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id integer PRIMARY KEY AUTOINCREMENT,
+	created_at datetime NOT NULL,
+	updated_at datetime NOT NULL,
+	user_id integer NOT NULL,
+	key text NOT NULL,
+	last_used_at datetime NOT NULL,
+	expires_at datetime NOT NULL,
+	CONSTRAINT fk_users_sessions FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_sessions_key ON sessions(key);
@@ -0,0 +1,19 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(
+	content=notes,
+	content_rowid=id,
+	body,
+	tokenize="porter unicode61 categories 'L* N* Co Ps Pe'"
+);
+
+CREATE TRIGGER IF NOT EXISTS notes_insert AFTER INSERT ON notes BEGIN
+	INSERT INTO notes_fts(rowid, body) VALUES (new.id, new.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_delete AFTER DELETE ON notes BEGIN
+	INSERT INTO notes_fts(notes_fts, rowid, body) VALUES ('delete', old.id, old.body);
+END;
+
+CREATE TRIGGER IF NOT EXISTS notes_update AFTER UPDATE ON notes BEGIN
+	INSERT INTO notes_fts(notes_fts, rowid, body) VALUES ('delete', old.id, old.body);
+	INSERT INTO notes_fts(rowid, body) VALUES (new.id, new.body);
+END;
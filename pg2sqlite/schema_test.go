@@ -0,0 +1,37 @@
+package pg2sqlite
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	dump := testDump + `
+COPY public.migrations (id, applied_at) FROM stdin;
+1-create-notes-fts.sql	2019-01-01 00:00:00+00
+2-add-client.sql	2019-06-01 00:00:00+00
+\.
+`
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, dump))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	report, err := preflight(context.Background(), src)
+	if err != nil {
+		t.Fatalf("preflight failed: %v", err)
+	}
+
+	if report.Version != schemaVersionV2 || !report.supported() {
+		t.Errorf("Version: expected %s, got %s", schemaVersionV2, report.Version)
+	}
+	if len(report.Migrations) != 2 || report.Migrations[1] != "2-add-client.sql" {
+		t.Errorf("Migrations: expected 2 ending in 2-add-client.sql, got %v", report.Migrations)
+	}
+	for _, table := range report.Tables {
+		if !table.Exists || len(table.Missing) > 0 || len(table.Extra) > 0 {
+			t.Errorf("%s: expected an exact match, got %+v", table.Name, table)
+		}
+	}
+}
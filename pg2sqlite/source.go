@@ -0,0 +1,375 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sourceColumns lists the columns read from each Dnote v2 table, in the order
+// the migrate functions scan them.
+var sourceColumns = map[string][]string{
+	"users":    {"id", "created_at", "updated_at", "uuid", "last_login_at", "max_usn", "cloud"},
+	"accounts": {"id", "created_at", "updated_at", "user_id", "email", "email_verified", "password"},
+	"books":    {"id", "created_at", "updated_at", "uuid", "user_id", "label", "added_on", "edited_on", "usn", "deleted", "encrypted"},
+	"notes":    {"id", "created_at", "updated_at", "uuid", "user_id", "book_uuid", "body", "added_on", "edited_on", "public", "usn", "deleted", "encrypted", "client"},
+	"tokens":   {"id", "created_at", "updated_at", "user_id", "value", "type", "used_at"},
+	"sessions": {"id", "created_at", "updated_at", "user_id", "key", "last_used_at", "expires_at"},
+}
+
+// Source provides the rows of a Dnote v2 database, either from a live
+// Postgres server or from a pg_dump file. Use NewPostgresSource or
+// OpenDumpSource to create one. Its methods may be called from several
+// goroutines at once.
+type Source interface {
+	// rows returns the rows of table whose id is greater than afterID,
+	// ordered by id, with the given columns in order. The rows are streamed,
+	// so callers can read as many as they need without loading the table.
+	rows(ctx context.Context, table string, columns []string, afterID int) (sourceRows, error)
+	// countRows returns the number of rows of table whose id is greater
+	// than afterID.
+	countRows(ctx context.Context, table string, afterID int) (int, error)
+	// changedRows returns the rows of table selected by c, ordered by id,
+	// with the given columns in order.
+	changedRows(ctx context.Context, table string, columns []string, c changes) (sourceRows, error)
+	// now returns the time on the source's clock as of which its rows are
+	// read, or the zero time if it has none.
+	now(ctx context.Context) (time.Time, error)
+	// tableColumns returns the columns of table, or nil if it does not exist.
+	tableColumns(ctx context.Context, table string) ([]string, error)
+	// appliedMigrations returns the IDs recorded in the server's migrations
+	// table, oldest first, or nil if there is no such table.
+	appliedMigrations(ctx context.Context) ([]string, error)
+	// serverVersion returns the version of the Postgres server the data
+	// comes from, or "" if it is not known.
+	serverVersion(ctx context.Context) (string, error)
+	Close() error
+}
+
+// sourceRows is the subset of *sql.Rows used to read from a source.
+type sourceRows interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+	Close() error
+}
+
+// pgSource reads from a live Postgres database. The v2 server may still be
+// writing to it, so every read runs in a REPEATABLE READ transaction that
+// imports one snapshot, and sees every table as of the same point in time.
+// Reads can run side by side on separate connections.
+type pgSource struct {
+	db *sql.DB
+
+	mu sync.Mutex
+	// holder exported the snapshot, and is kept open until Close so that
+	// it can still be imported
+	holder   *sql.Tx
+	snapshot string
+	taken    time.Time // when the snapshot was taken, on the server's clock
+}
+
+// NewPostgresSource returns a Source that reads from the Dnote v2 database
+// behind db. The snapshot it reads is taken on the first read. Closing the
+// source closes db.
+func NewPostgresSource(db *sql.DB) Source {
+	return &pgSource{db: db}
+}
+
+// export takes the snapshot that every read imports, unless it has already
+// been taken.
+func (s *pgSource) export(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.holder != nil {
+		return nil
+	}
+
+	// The holder outlives the read that starts it
+	tx, err := s.db.BeginTx(context.WithoutCancel(ctx), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT pg_export_snapshot(), now()").Scan(&s.snapshot, &s.taken); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("exporting snapshot: %w", err)
+	}
+	s.holder = tx
+
+	return nil
+}
+
+// begin starts a read-only transaction that sees the snapshot.
+func (s *pgSource) begin(ctx context.Context) (*sql.Tx, error) {
+	if err := s.export(ctx); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SET TRANSACTION SNAPSHOT '"+s.snapshot+"'"); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("importing snapshot: %w", err)
+	}
+
+	return tx, nil
+}
+
+// read runs fn in a transaction that sees the snapshot.
+func (s *pgSource) read(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	return fn(tx)
+}
+
+// pgFetchSize is the number of rows fetched from a server-side cursor at a
+// time.
+const pgFetchSize = 5000
+
+// rows reads table through a server-side cursor, so that Postgres neither
+// materializes nor sends the whole result at once. Canceling ctx rolls back
+// the transaction holding the cursor.
+func (s *pgSource) rows(ctx context.Context, table string, columns []string, afterID int) (sourceRows, error) {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR SELECT %s FROM %s WHERE id > %d ORDER BY id",
+		cursorName(table), strings.Join(columns, ", "), table, afterID)
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &cursorRows{ctx: ctx, tx: tx, name: cursorName(table)}, nil
+}
+
+func (s *pgSource) countRows(ctx context.Context, table string, afterID int) (int, error) {
+	var count int
+	err := s.read(ctx, func(tx *sql.Tx) error {
+		return tx.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id > $1", table), afterID).Scan(&count)
+	})
+
+	return count, err
+}
+
+// changedRows passes the USN of every user as a pair of arrays, as changes
+// are few and a sync runs while the server is busy.
+func (s *pgSource) changedRows(ctx context.Context, table string, columns []string, c changes) (sourceRows, error) {
+	where := "updated_at >= $1"
+	args := []any{c.since}
+
+	// A user missing from the target compares with NULL, so only the
+	// updated_at of its rows counts
+	if cols, ok := usnColumns[table]; ok && len(c.usns) > 0 {
+		users := make([]string, 0, len(c.usns))
+		usns := make([]string, 0, len(c.usns))
+		for id, usn := range c.usns {
+			users = append(users, strconv.Itoa(id))
+			usns = append(usns, strconv.Itoa(usn))
+		}
+
+		where += fmt.Sprintf(" OR %[1]s.%[2]s > (SELECT m.usn FROM unnest($2::int[], $3::int[]) AS m(user_id, usn) WHERE m.user_id = %[1]s.%[3]s)",
+			table, cols[1], cols[0])
+		args = append(args, "{"+strings.Join(users, ",")+"}", "{"+strings.Join(usns, ",")+"}")
+	}
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY id", strings.Join(columns, ", "), table, where), args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &txRows{Rows: rows, tx: tx}, nil
+}
+
+// now returns when the snapshot was taken, which is before any row was
+// read.
+func (s *pgSource) now(ctx context.Context) (time.Time, error) {
+	if err := s.export(ctx); err != nil {
+		return time.Time{}, err
+	}
+
+	return s.taken, nil
+}
+
+// txRows ends the transaction its rows were read in when they are closed.
+type txRows struct {
+	*sql.Rows
+	tx *sql.Tx
+}
+
+func (r *txRows) Close() error {
+	r.Rows.Close()
+	return r.tx.Rollback()
+}
+
+func cursorName(table string) string {
+	return "pg2sqlite_" + table
+}
+
+// cursorRows iterates over a server-side cursor, fetching the next chunk of
+// rows whenever the current one runs out.
+type cursorRows struct {
+	ctx   context.Context
+	tx    *sql.Tx
+	name  string
+	chunk *sql.Rows
+	n     int // rows read from chunk
+	done  bool
+	err   error
+}
+
+func (r *cursorRows) Next() bool {
+	if r.done || r.err != nil {
+		return false
+	}
+
+	for {
+		if r.chunk == nil {
+			r.chunk, r.err = r.tx.QueryContext(r.ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", pgFetchSize, r.name))
+			if r.err != nil {
+				return false
+			}
+			r.n = 0
+		}
+
+		if r.chunk.Next() {
+			r.n++
+			return true
+		}
+		if r.err = r.chunk.Err(); r.err != nil {
+			return false
+		}
+
+		r.chunk.Close()
+		r.chunk = nil
+
+		// A short chunk means the cursor is exhausted
+		if r.n < pgFetchSize {
+			r.done = true
+			return false
+		}
+	}
+}
+
+func (r *cursorRows) Scan(dest ...any) error {
+	return r.chunk.Scan(dest...)
+}
+
+func (r *cursorRows) Err() error {
+	return r.err
+}
+
+// Close ends the read-only transaction, which also closes the cursor.
+func (r *cursorRows) Close() error {
+	if r.chunk != nil {
+		r.chunk.Close()
+		r.chunk = nil
+	}
+	if r.tx == nil {
+		return nil
+	}
+
+	err := r.tx.Rollback()
+	r.tx = nil
+	return err
+}
+
+func (s *pgSource) tableColumns(ctx context.Context, table string) ([]string, error) {
+	var columns []string
+	err := s.read(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT column_name
+			FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = $1
+			ORDER BY ordinal_position
+		`, table)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var c string
+			if err := rows.Scan(&c); err != nil {
+				return err
+			}
+			columns = append(columns, c)
+		}
+
+		return rows.Err()
+	})
+
+	return columns, err
+}
+
+func (s *pgSource) appliedMigrations(ctx context.Context) ([]string, error) {
+	columns, err := s.tableColumns(ctx, migrationsTable)
+	if err != nil || columns == nil {
+		return nil, err
+	}
+
+	orderBy := "id"
+	if slices.Contains(columns, "applied_at") {
+		orderBy = "applied_at, id"
+	}
+
+	var ids []string
+	err = s.read(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id FROM %s ORDER BY %s", migrationsTable, orderBy))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+
+		return rows.Err()
+	})
+
+	return ids, err
+}
+
+func (s *pgSource) serverVersion(ctx context.Context) (string, error) {
+	var version string
+	err := s.db.QueryRowContext(ctx, "SHOW server_version").Scan(&version)
+
+	return version, err
+}
+
+// Close releases the snapshot and closes the database.
+func (s *pgSource) Close() error {
+	s.mu.Lock()
+	if s.holder != nil {
+		s.holder.Rollback()
+		s.holder = nil
+	}
+	s.mu.Unlock()
+
+	return s.db.Close()
+}
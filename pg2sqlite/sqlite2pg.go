@@ -0,0 +1,260 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// tsvConfig is the text search configuration Dnote v2 builds notes.tsv with.
+const tsvConfig = "english"
+
+// RollbackOptions configure Rollback. The zero value copies in batches of
+// DefaultBatchSize.
+type RollbackOptions struct {
+	// BatchSize is the number of rows read from SQLite and inserted into
+	// Postgres at a time
+	BatchSize int
+	// Progress is called after every batch, if set
+	Progress func(Progress)
+	// Logf receives a line for each step of the rollback, if set
+	Logf func(format string, args ...any)
+}
+
+// Rollback copies a Dnote v3 SQLite database back into the Dnote v2 schema
+// in Postgres, so that a server can go back to v2 without losing what was
+// written after the upgrade. The v2 tables are created from the Pg models
+// unless they already exist, for example restored with pg_restore
+// --schema-only from the backup taken before migrating, in which case they
+// must be empty.
+//
+// The columns v3 does not keep get their v2 defaults: no book or note is
+// encrypted, no email address is verified, users.cloud is false and
+// notes.tsv is rebuilt from the body.
+// The id sequences are moved past the copied ids. Everything is written in
+// one transaction, so a failed rollback leaves Postgres as it was.
+func Rollback(ctx context.Context, sqliteDB, pgDB *sql.DB, opts RollbackOptions) (*Result, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Progress == nil {
+		opts.Progress = func(Progress) {}
+	}
+	if opts.Logf == nil {
+		opts.Logf = func(string, ...any) {}
+	}
+
+	partial, err := HasCheckpoints(ctx, sqliteDB)
+	if err != nil {
+		return nil, fmt.Errorf("checking for checkpoints: %w", err)
+	}
+	if partial {
+		return nil, fmt.Errorf("the SQLite database is an unfinished migration, not a Dnote v3 database")
+	}
+
+	config := &gorm.Config{Logger: logger.Discard}
+	src, err := gorm.Open(sqlite.New(sqlite.Config{Conn: sqliteDB}), config)
+	if err != nil {
+		return nil, fmt.Errorf("opening SQLite: %w", err)
+	}
+	dst, err := gorm.Open(postgres.New(postgres.Config{Conn: pgDB}), config)
+	if err != nil {
+		return nil, fmt.Errorf("opening Postgres: %w", err)
+	}
+
+	var result Result
+	err = dst.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := prepareRollbackTarget(tx, opts.Logf); err != nil {
+			return err
+		}
+
+		r := rollback{src: src.WithContext(ctx), dst: tx, opts: opts, result: &result}
+		stats := &result.Stats
+		for _, copyTable := range []func() error{
+			func() error { return rollbackTable(r, "users", &stats.Users, rollbackUser) },
+			func() error { return rollbackTable(r, "accounts", &stats.Accounts, rollbackAccount) },
+			func() error { return rollbackTable(r, "books", &stats.Books, rollbackBook) },
+			func() error { return rollbackTable(r, "notes", &stats.Notes, rollbackNote) },
+			func() error { return rollbackTable(r, "tokens", &stats.Tokens, rollbackToken) },
+			func() error { return rollbackTable(r, "sessions", &stats.Sessions, rollbackSession) },
+		} {
+			if err := copyTable(); err != nil {
+				return err
+			}
+		}
+
+		opts.Logf("Rebuilding the notes search index...")
+		if err := tx.Exec("UPDATE notes SET tsv = to_tsvector(?, body)", tsvConfig).Error; err != nil {
+			return fmt.Errorf("rebuilding notes.tsv: %w", err)
+		}
+
+		// Rows were inserted with their ids, which the sequences did not see
+		opts.Logf("Resetting id sequences...")
+		for _, model := range rollbackModels {
+			table := tableName(model)
+			next, err := nextID(tx, table)
+			if err == nil {
+				err = tx.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), ?, false)", table, next).Error
+			}
+			if err != nil {
+				return fmt.Errorf("resetting the %s id sequence: %w", table, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// rollbackModels are the Dnote v2 tables, parents first.
+var rollbackModels = []any{&PgUser{}, &PgAccount{}, &PgBook{}, &PgNote{}, &PgToken{}, &PgSession{}}
+
+// tableName returns the table of one of the rollbackModels.
+func tableName(model any) string {
+	return model.(interface{ TableName() string }).TableName()
+}
+
+// nextID returns the id the sequence of table should give out next, the one
+// after the highest id copied into it.
+func nextID(tx *gorm.DB, table string) (int, error) {
+	var maxID int
+	if err := tx.Table(table).Select("COALESCE(MAX(id), 0)").Scan(&maxID).Error; err != nil {
+		return 0, err
+	}
+
+	return maxID + 1, nil
+}
+
+// prepareRollbackTarget creates the Dnote v2 tables if there are none, and
+// otherwise makes sure that all of them exist and are empty.
+func prepareRollbackTarget(tx *gorm.DB, logf func(string, ...any)) error {
+	var missing, existing []string
+	for _, model := range rollbackModels {
+		table := tableName(model)
+		if tx.Migrator().HasTable(table) {
+			existing = append(existing, table)
+		} else {
+			missing = append(missing, table)
+		}
+	}
+
+	if len(existing) == 0 {
+		logf("Creating the Dnote v2 schema...")
+		if err := tx.Exec(`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`).Error; err != nil {
+			return fmt.Errorf("creating uuid extension: %w", err)
+		}
+		if err := tx.AutoMigrate(rollbackModels...); err != nil {
+			return fmt.Errorf("creating Dnote v2 schema: %w", err)
+		}
+		return nil
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the Postgres database has some Dnote v2 tables but not %v", missing)
+	}
+
+	for _, table := range existing {
+		var found bool
+		if err := tx.Raw(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s)", table)).Scan(&found).Error; err != nil {
+			return fmt.Errorf("checking %s: %w", table, err)
+		}
+		if found {
+			return fmt.Errorf("the Postgres table %s already has rows - roll back into an empty database", table)
+		}
+	}
+
+	return nil
+}
+
+// rollback is the state shared by the tables of a Rollback.
+type rollback struct {
+	src    *gorm.DB
+	dst    *gorm.DB
+	opts   RollbackOptions
+	result *Result
+}
+
+// rollbackTable copies table from the Sqlite model S to the Pg model P in
+// batches, converting each row with convert. count is kept up to date with
+// the number of rows copied so far.
+func rollbackTable[S, P any](r rollback, table string, count *int, convert func(S) P) error {
+	r.opts.Logf("Copying %s...", table)
+
+	var total int64
+	if err := r.src.Table(table).Count(&total).Error; err != nil {
+		return fmt.Errorf("counting %s: %w", table, err)
+	}
+
+	ts := TableStats{Name: table}
+	p := Progress{Table: table, Total: int(total)}
+	start := time.Now()
+
+	var rows []S
+	err := r.src.FindInBatches(&rows, r.opts.BatchSize, func(_ *gorm.DB, _ int) error {
+		converted := make([]P, len(rows))
+		for i, row := range rows {
+			converted[i] = convert(row)
+		}
+		if err := r.dst.Omit(clause.Associations).Create(&converted).Error; err != nil {
+			return err
+		}
+
+		ts.Read += len(rows)
+		ts.Written += len(rows)
+		*count = ts.Written
+		ts.Duration = time.Since(start)
+		p.Rows, p.Read, p.Elapsed = ts.Written, ts.Read, ts.Duration
+		r.opts.Progress(p)
+		return nil
+	}).Error
+	if err != nil {
+		return fmt.Errorf("copying %s: %w", table, err)
+	}
+
+	r.result.Tables = append(r.result.Tables, ts)
+	p.Done = true
+	r.opts.Progress(p)
+	r.opts.Logf("  Copied %d %s", ts.Written, table)
+
+	return nil
+}
+
+func rollbackUser(u SqliteUser) PgUser {
+	return PgUser{PgModel: PgModel(u.SqliteModel), UUID: u.UUID, LastLoginAt: u.LastLoginAt, MaxUSN: u.MaxUSN}
+}
+
+func rollbackAccount(a SqliteAccount) PgAccount {
+	return PgAccount{PgModel: PgModel(a.SqliteModel), UserID: a.UserID, Email: a.Email, Password: a.Password}
+}
+
+func rollbackBook(b SqliteBook) PgBook {
+	return PgBook{
+		PgModel: PgModel(b.SqliteModel), UUID: b.UUID, UserID: b.UserID, Label: b.Label,
+		AddedOn: b.AddedOn, EditedOn: b.EditedOn, USN: b.USN, Deleted: b.Deleted,
+	}
+}
+
+func rollbackNote(n SqliteNote) PgNote {
+	return PgNote{
+		PgModel: PgModel(n.SqliteModel), UUID: n.UUID, UserID: n.UserID, BookUUID: n.BookUUID, Body: n.Body,
+		AddedOn: n.AddedOn, EditedOn: n.EditedOn, Public: n.Public, USN: n.USN, Deleted: n.Deleted, Client: n.Client,
+	}
+}
+
+func rollbackToken(t SqliteToken) PgToken {
+	return PgToken{PgModel: PgModel(t.SqliteModel), UserID: t.UserID, Value: t.Value, Type: t.Type, UsedAt: t.UsedAt}
+}
+
+func rollbackSession(s SqliteSession) PgSession {
+	return PgSession{PgModel: PgModel(s.SqliteModel), UserID: s.UserID, Key: s.Key, LastUsedAt: s.LastUsedAt, ExpiresAt: s.ExpiresAt}
+}
@@ -0,0 +1,148 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestGorm opens db, a SQLite database from openTestSQLite, with gorm.
+// The v3 tables have the names of the v2 ones, so it stands in for Postgres
+// in the parts of Rollback that do not depend on it.
+func openTestGorm(t *testing.T, db *sql.DB) *gorm.DB {
+	g, err := gorm.Open(sqlite.New(sqlite.Config{Conn: db}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("Failed to open gorm: %v", err)
+	}
+
+	return g
+}
+
+func TestRollbackUnfinishedMigration(t *testing.T) {
+	db := openTestSQLite(t, "partial.db")
+	if err := initCheckpoints(context.Background(), db); err != nil {
+		t.Fatalf("Failed to create checkpoint table: %v", err)
+	}
+
+	// Refused before Postgres is touched
+	_, err := Rollback(context.Background(), db, nil, RollbackOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unfinished migration") {
+		t.Errorf("Expected an unfinished migration to be refused, got %v", err)
+	}
+}
+
+func TestPrepareRollbackTarget(t *testing.T) {
+	db := openTestSQLite(t, "target.db")
+	tx := openTestGorm(t, db)
+	logf := func(string, ...any) {}
+
+	// Empty tables restored from a backup are used as they are
+	if err := prepareRollbackTarget(tx, logf); err != nil {
+		t.Errorf("Expected empty tables to be accepted, got %v", err)
+	}
+
+	now := time.Now()
+	if _, err := db.Exec(`INSERT INTO notes (id, created_at, updated_at, uuid, user_id, book_uuid, body, added_on, edited_on, public, usn, deleted, client)
+		VALUES (1, ?, ?, 'uuid-1', 1, 'book-1', 'body', 0, 0, false, 1, false, 'cli')`, now, now); err != nil {
+		t.Fatalf("Failed to insert note: %v", err)
+	}
+	err := prepareRollbackTarget(tx, logf)
+	if err == nil || !strings.Contains(err.Error(), "table notes already has rows") {
+		t.Errorf("Expected the non-empty notes table to be refused, got %v", err)
+	}
+
+	if _, err := db.Exec("DROP TABLE sessions"); err != nil {
+		t.Fatalf("Failed to drop sessions: %v", err)
+	}
+	err = prepareRollbackTarget(tx, logf)
+	if err == nil || !strings.Contains(err.Error(), "but not [sessions]") {
+		t.Errorf("Expected the missing sessions table to be refused, got %v", err)
+	}
+}
+
+func TestRollbackTable(t *testing.T) {
+	srcDB := openTestSQLite(t, "source.db")
+	dstDB := openTestSQLite(t, "target.db")
+
+	// Written out of id order, and with a gap
+	now := time.Now()
+	for _, id := range []int{7, 2, 5, 1, 3} {
+		if _, err := srcDB.Exec(`INSERT INTO books (id, created_at, updated_at, uuid, user_id, label, added_on, edited_on, usn, deleted)
+			VALUES (?, ?, ?, ?, 1, ?, 0, 0, 1, false)`, id, now, now, fmt.Sprintf("uuid-%d", id), "label"); err != nil {
+			t.Fatalf("Failed to insert book %d: %v", id, err)
+		}
+	}
+
+	var progress []Progress
+	var result Result
+	r := rollback{
+		src: openTestGorm(t, srcDB),
+		dst: openTestGorm(t, dstDB),
+		opts: RollbackOptions{
+			BatchSize: 2,
+			Progress:  func(p Progress) { progress = append(progress, p) },
+			Logf:      func(string, ...any) {},
+		},
+		result: &result,
+	}
+
+	var order []int
+	var count int
+	err := rollbackTable(r, "books", &count, func(b SqliteBook) SqliteBook {
+		order = append(order, b.ID)
+		return b
+	})
+	if err != nil {
+		t.Fatalf("rollbackTable failed: %v", err)
+	}
+
+	if fmt.Sprint(order) != "[1 2 3 5 7]" {
+		t.Errorf("Expected the rows in id order, got %v", order)
+	}
+	if count != 5 {
+		t.Errorf("Expected 5 rows copied, got %d", count)
+	}
+
+	// One report per batch of 2, then one for the finished table
+	var rows []int
+	for _, p := range progress {
+		rows = append(rows, p.Rows)
+	}
+	if len(progress) != 4 || fmt.Sprint(rows) != "[2 4 5 5]" || !progress[3].Done || progress[2].Done {
+		t.Errorf("Expected progress after 2, 4 and 5 rows and then done, got %+v", progress)
+	}
+	if len(result.Tables) != 1 || result.Tables[0].Written != 5 {
+		t.Errorf("Expected the table stats to show 5 rows, got %+v", result.Tables)
+	}
+
+	var copied int
+	if err := dstDB.QueryRow("SELECT COUNT(*) FROM books").Scan(&copied); err != nil {
+		t.Fatalf("Failed to count books: %v", err)
+	}
+	if copied != 5 {
+		t.Errorf("Expected 5 books in the target, got %d", copied)
+	}
+
+	// The sequences continue after the highest copied id, past any gap
+	next, err := nextID(r.dst, "books")
+	if err != nil {
+		t.Fatalf("nextID failed: %v", err)
+	}
+	if next != 8 {
+		t.Errorf("books: expected the next id to be 8, got %d", next)
+	}
+	next, err = nextID(r.dst, "notes")
+	if err != nil {
+		t.Fatalf("nextID failed: %v", err)
+	}
+	if next != 1 {
+		t.Errorf("notes: expected an empty table to start at 1, got %d", next)
+	}
+}
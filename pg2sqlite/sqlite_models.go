@@ -0,0 +1,98 @@
+package pg2sqlite
+
+import (
+	"time"
+)
+
+// SQLite models from sqlite branch
+
+type SqliteModel struct {
+	ID        int       `gorm:"primaryKey" json:"-"`
+	CreatedAt time.Time `json:"created_at" gorm:"autoCreateTime;not null"`
+	UpdatedAt time.Time `json:"updated_at" gorm:"autoUpdateTime;not null"`
+}
+
+type SqliteBook struct {
+	SqliteModel
+	UUID      string       `json:"uuid" gorm:"uniqueIndex;type:text;not null"`
+	UserID    int          `json:"user_id" gorm:"index;not null"`
+	Label     string       `json:"label" gorm:"index;not null"`
+	Notes     []SqliteNote `json:"notes" gorm:"foreignKey:BookUUID;references:UUID"`
+	AddedOn  int64 `json:"added_on" gorm:"not null"`
+	EditedOn int64 `json:"edited_on" gorm:"not null"`
+	USN      int   `json:"-" gorm:"index;not null"`
+	Deleted  bool  `json:"-" gorm:"not null;default:false"`
+}
+
+func (SqliteBook) TableName() string {
+	return "books"
+}
+
+type SqliteNote struct {
+	SqliteModel
+	UUID      string `json:"uuid" gorm:"uniqueIndex;type:text;not null"`
+	UserID    int    `json:"user_id" gorm:"index;not null"`
+	BookUUID  string `json:"book_uuid" gorm:"index;type:text;not null"`
+	Body      string `json:"content" gorm:"not null"`
+	AddedOn   int64  `json:"added_on" gorm:"not null"`
+	EditedOn  int64  `json:"edited_on" gorm:"not null"`
+	Public  bool   `json:"public" gorm:"not null;default:false"`
+	USN     int    `json:"-" gorm:"index;not null"`
+	Deleted bool   `json:"-" gorm:"not null;default:false"`
+	Client  string `gorm:"index;not null"`
+}
+
+func (SqliteNote) TableName() string {
+	return "notes"
+}
+
+type SqliteUser struct {
+	SqliteModel
+	UUID        string         `json:"uuid" gorm:"type:text;uniqueIndex;not null"`
+	Account     SqliteAccount  `gorm:"foreignKey:UserID"`
+	Books       []SqliteBook    `json:"-" gorm:"foreignKey:UserID"`
+	Notes       []SqliteNote    `json:"-" gorm:"foreignKey:UserID"`
+	Tokens      []SqliteToken   `json:"-" gorm:"foreignKey:UserID"`
+	Sessions    []SqliteSession `json:"-" gorm:"foreignKey:UserID"`
+	LastLoginAt *time.Time     `json:"-"`
+	MaxUSN      int            `json:"-" gorm:"not null;default:0"`
+}
+
+func (SqliteUser) TableName() string {
+	return "users"
+}
+
+type SqliteAccount struct {
+	SqliteModel
+	UserID   int        `gorm:"index;not null"`
+	Email    NullString
+	Password NullString
+}
+
+func (SqliteAccount) TableName() string {
+	return "accounts"
+}
+
+type SqliteToken struct {
+	SqliteModel
+	UserID int        `gorm:"index;not null"`
+	Value  string     `gorm:"index;not null"`
+	Type   string     `gorm:"not null"`
+	UsedAt *time.Time
+}
+
+func (SqliteToken) TableName() string {
+	return "tokens"
+}
+
+type SqliteSession struct {
+	SqliteModel
+	UserID     int       `gorm:"index;not null"`
+	Key        string    `gorm:"index;not null"`
+	LastUsedAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null"`
+}
+
+func (SqliteSession) TableName() string {
+	return "sessions"
+}
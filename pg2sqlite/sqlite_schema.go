@@ -0,0 +1,54 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+)
+
+// sqliteSchema is the Dnote v3 schema this tool creates, one file per step,
+// applied in the order of their names. It follows the Sqlite models, with
+// the constraints Dnote v3 enforces, but it is not the server's own
+// migrations: nothing is recorded in the server's migrations table, so the
+// server applies its migrations itself on first boot. Every statement is
+// idempotent, so a resumed migration applies the files again.
+//
+//go:embed schema/*.sql
+var sqliteSchema embed.FS
+
+// initSchema creates the Dnote v3 schema in db, each file of sqliteSchema in
+// its own transaction.
+func initSchema(ctx context.Context, db *sql.DB) error {
+	entries, err := sqliteSchema.ReadDir("schema")
+	if err != nil {
+		return fmt.Errorf("loading schema: %w", err)
+	}
+
+	for _, e := range entries {
+		ddl, err := sqliteSchema.ReadFile(path.Join("schema", e.Name()))
+		if err != nil {
+			return fmt.Errorf("loading schema: %w", err)
+		}
+		if err := applySchemaFile(ctx, db, string(ddl)); err != nil {
+			return fmt.Errorf("applying %s: %w", e.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func applySchemaFile(ctx context.Context, db *sql.DB, ddl string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, ddl); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,34 @@
+package pg2sqlite
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInitSchema(t *testing.T) {
+	db := openTestSQLite(t, "schema.db")
+
+	// Applying the schema again, as a resumed run does, changes nothing
+	if err := initSchema(context.Background(), db); err != nil {
+		t.Fatalf("Second initSchema failed: %v", err)
+	}
+
+	for _, table := range append(tableOrder, "notes_fts") {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = ?", table).Scan(&count); err != nil {
+			t.Fatalf("Failed to look up %s: %v", table, err)
+		}
+		if count != 1 {
+			t.Errorf("Expected table %s to exist", table)
+		}
+	}
+
+	// The server's migrations table is left for the server to create
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'migrations'").Scan(&count); err != nil {
+		t.Fatalf("Failed to look up migrations: %v", err)
+	}
+	if count != 0 {
+		t.Error("Expected no migrations table")
+	}
+}
@@ -0,0 +1,414 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// syncTable marks a target as a copy of its source that can be synced, and
+// holds the high-water mark: the source's clock when the migration, or the
+// last sync, started reading, along with the syncSettings of the migration.
+// Unlike the checkpoints it is kept once the migration completes, and can be
+// dropped once Dnote v3 has taken over.
+const syncTable = "pg2sqlite_sync"
+
+// syncOverlap is how long before the high-water mark a sync starts looking
+// for changed rows. updated_at comes from the clock of the v2 server rather
+// than the database's, and a transaction in flight at the mark can commit
+// rows dated before it, so the rows of the last few minutes are copied again.
+const syncOverlap = 5 * time.Minute
+
+// changes selects the source rows that a sync copies.
+type changes struct {
+	since time.Time
+	// usns holds the max_usn of every user in the target. Books and notes
+	// with a higher USN, and users with a higher max_usn, have changed
+	// whatever their updated_at says.
+	usns map[int]int
+}
+
+// usnColumns names the user and USN columns that are compared with
+// changes.usns, for the tables that have them.
+var usnColumns = map[string][2]string{
+	"users": {"id", "max_usn"},
+	"books": {"user_id", "usn"},
+	"notes": {"user_id", "usn"},
+}
+
+// changed reports whether a row of the user with userID, last updated at
+// updatedAt and with the given USN, is selected by c.
+func (c changes) changed(userID, usn int, updatedAt time.Time) bool {
+	if !updatedAt.Before(c.since) {
+		return true
+	}
+
+	mark, ok := c.usns[userID]
+	return ok && usn > mark
+}
+
+// syncSettings are the options that decide which source rows a migration
+// copies. A sync has to copy with the same ones, or it would bring in rows
+// the migration left out, such as the rows of other users into a database
+// split off for one of them.
+type syncSettings struct {
+	UserUUIDs  []string        `json:"user_uuids,omitempty"`
+	UserEmails []string        `json:"user_emails,omitempty"`
+	Tables     []string        `json:"tables"`
+	Encrypted  EncryptedPolicy `json:"encrypted"`
+	Orphans    OrphanPolicy    `json:"orphans"`
+}
+
+// syncSettings returns the settings m copies with. Users are compared the
+// way the filter matches them, ignoring case and order, and tables by the
+// set the filter selects.
+func (m *Migrator) syncSettings() (syncSettings, error) {
+	tables, err := m.filter.tables()
+	if err != nil {
+		return syncSettings{}, err
+	}
+
+	s := syncSettings{
+		UserUUIDs:  normalizeList(m.filter.UserUUIDs),
+		UserEmails: normalizeList(m.filter.UserEmails),
+		Encrypted:  m.encrypted,
+		Orphans:    m.orphans,
+	}
+	for _, t := range tableOrder {
+		if tables[t] {
+			s.Tables = append(s.Tables, t)
+		}
+	}
+
+	return s, nil
+}
+
+func normalizeList(values []string) []string {
+	var normalized []string
+	for _, v := range values {
+		normalized = append(normalized, strings.ToLower(v))
+	}
+	slices.Sort(normalized)
+
+	return slices.Compact(normalized)
+}
+
+// String describes s as the command line options that select it.
+func (s syncSettings) String() string {
+	var opts []string
+	if len(s.UserUUIDs) > 0 {
+		opts = append(opts, "--user-uuid="+strings.Join(s.UserUUIDs, ","))
+	}
+	if len(s.UserEmails) > 0 {
+		opts = append(opts, "--user-email="+strings.Join(s.UserEmails, ","))
+	}
+	if len(s.Tables) < len(tableOrder) {
+		opts = append(opts, "--tables="+strings.Join(s.Tables, ","))
+	}
+	opts = append(opts, "--encrypted="+string(s.Encrypted), "--orphans="+string(s.Orphans))
+
+	return strings.Join(opts, " ")
+}
+
+// initSyncMark creates the sync table with the given high-water mark and
+// settings. A resumed migration keeps the mark and settings of the run that
+// started it. The zero time records that the source has no clock.
+func initSyncMark(ctx context.Context, db *sql.DB, mark time.Time, settings syncSettings) error {
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS `+syncTable+` (
+			id INTEGER PRIMARY KEY CHECK (id = 1),
+			mark DATETIME,
+			settings TEXT NOT NULL
+		)
+	`); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO "+syncTable+" (id, mark, settings) VALUES (1, ?, ?) ON CONFLICT (id) DO NOTHING", nullTime(mark), string(encoded))
+	return err
+}
+
+// readSyncSettings returns the settings recorded by the migration that
+// created the sync table.
+func readSyncSettings(ctx context.Context, db *sql.DB) (syncSettings, error) {
+	var encoded string
+	if err := db.QueryRowContext(ctx, "SELECT settings FROM "+syncTable+" WHERE id = 1").Scan(&encoded); err != nil {
+		return syncSettings{}, err
+	}
+
+	var s syncSettings
+	if err := json.Unmarshal([]byte(encoded), &s); err != nil {
+		return syncSettings{}, err
+	}
+
+	return s, nil
+}
+
+// saveSyncMark replaces the high-water mark once a sync has copied
+// everything up to it.
+func saveSyncMark(ctx context.Context, tx *sql.Tx, mark time.Time) error {
+	_, err := tx.ExecContext(ctx, "UPDATE "+syncTable+" SET mark = ? WHERE id = 1", nullTime(mark))
+	return err
+}
+
+func dropSyncMark(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS "+syncTable)
+	return err
+}
+
+// SyncMark returns the high-water mark recorded in db by the migration or
+// sync that last wrote to it. ok is false if db cannot be synced, as it was
+// not created by a migration or has been merged into. The mark is the zero
+// time if the source had no clock, as with a pg_dump file.
+func SyncMark(ctx context.Context, db *sql.DB) (mark time.Time, ok bool, err error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", syncTable).Scan(&count); err != nil {
+		return time.Time{}, false, err
+	}
+	if count == 0 {
+		return time.Time{}, false, nil
+	}
+
+	var t sql.NullTime
+	if err := db.QueryRowContext(ctx, "SELECT mark FROM "+syncTable+" WHERE id = 1").Scan(&t); err != nil {
+		return time.Time{}, false, err
+	}
+
+	return t.Time, true, nil
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// Sync brings a target created by an earlier Run up to date with a source
+// that kept changing while it was copied. It copies the rows changed since
+// the time since, or since the recorded high-water mark if since is zero,
+// and removes the rows that are gone from the source, all in one
+// transaction, so that the final switch-over only waits for the changes.
+//
+// Changes are found by updated_at and, for users, books and notes, by USN.
+// Books and notes are deleted in v2 by setting their deleted flag, which
+// updates both. Rows removed outright, such as the sessions of users who
+// signed out, are found by comparing ids.
+func (m *Migrator) Sync(ctx context.Context, since time.Time) (*Result, error) {
+	if m.merging {
+		return nil, fmt.Errorf("a merge cannot be synced")
+	}
+	if m.orphans == OrphanReparent {
+		return nil, fmt.Errorf("syncing does not support the reparent orphan policy, as recovered books take ids that the source may have given out since")
+	}
+
+	mark, ok, err := SyncMark(ctx, m.sqliteDB)
+	if err != nil {
+		return nil, fmt.Errorf("reading sync mark: %w", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("the target has no sync mark, so it was not created by a migration or has been merged into")
+	}
+	recorded, err := readSyncSettings(ctx, m.sqliteDB)
+	if err != nil {
+		return nil, fmt.Errorf("reading sync settings: %w", err)
+	}
+	settings, err := m.syncSettings()
+	if err != nil {
+		return nil, err
+	}
+	if settings.String() != recorded.String() {
+		return nil, fmt.Errorf("the target was migrated with %s, but the sync was given %s - sync with the options of the migration", recorded, settings)
+	}
+	unfinished, err := HasCheckpoints(ctx, m.sqliteDB)
+	if err != nil {
+		return nil, fmt.Errorf("checking for checkpoints: %w", err)
+	}
+	if unfinished {
+		return nil, fmt.Errorf("the target is an unfinished migration - resume it before syncing")
+	}
+	if since.IsZero() {
+		if mark.IsZero() {
+			return nil, fmt.Errorf("no high-water mark was recorded, as the target was migrated from a pg_dump file - pass a time from before the dump was taken")
+		}
+		since = mark
+	}
+
+	if err := m.Check(ctx); err != nil {
+		return nil, err
+	}
+
+	// Read the source's clock before any rows, so that the next sync picks
+	// up whatever changes while this one reads
+	now, err := m.src.now(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading the source's clock: %w", err)
+	}
+
+	if _, err := m.sqliteDB.ExecContext(ctx, "PRAGMA foreign_keys = ON"); err != nil {
+		return nil, fmt.Errorf("enabling foreign keys: %w", err)
+	}
+
+	c := changes{since: since.Add(-syncOverlap), usns: map[int]int{}}
+	err = queryTarget(ctx, m.sqliteDB, "SELECT id, max_usn FROM users", func(scan func(...any) error) error {
+		var id, usn int
+		if err := scan(&id, &usn); err != nil {
+			return err
+		}
+		c.usns[id] = usn
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading target users: %w", err)
+	}
+
+	m.logf("Syncing changes since %s...", c.since.UTC().Format(time.RFC3339))
+	m.syncing = true
+	if err := m.sync(ctx, c, now); err != nil {
+		return nil, err
+	}
+
+	m.logf("Checking database integrity...")
+	if err := checkIntegrity(ctx, m.sqliteDB); err != nil {
+		return nil, fmt.Errorf("checking database integrity: %w", err)
+	}
+
+	if err := m.findDroppedColumns(ctx); err != nil {
+		return nil, fmt.Errorf("comparing columns: %w", err)
+	}
+
+	if err := m.findUnverified(ctx); err != nil {
+		return nil, fmt.Errorf("reading verified accounts: %w", err)
+	}
+
+	return &Result{Schema: m.schema, Stats: m.stats, Tables: m.tables, Skipped: m.skipped, Unverified: m.unverified, Warnings: m.warnings}, nil
+}
+
+func (m *Migrator) sync(ctx context.Context, c changes, now time.Time) error {
+	tx, err := m.sqliteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Parents are written first and deleted last, so that every reference
+	// holds at each step
+	var copies []tableCopy
+	for _, t := range m.tableCopies() {
+		if !m.sel.table(t.name) {
+			m.logf("Skipping %s", t.name)
+			continue
+		}
+		copies = append(copies, t)
+
+		start := time.Now()
+		rows, err := m.src.changedRows(ctx, t.name, sourceColumns[t.name], c)
+		if err != nil {
+			return fmt.Errorf("syncing %s: %w", t.name, err)
+		}
+		b, err := t.fn(ctx, tx, rows, math.MaxInt)
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("syncing %s: %w", t.name, err)
+		}
+
+		*t.count = b.written
+		m.tables = append(m.tables, TableStats{
+			Name:     t.name,
+			Read:     b.read,
+			Written:  b.written,
+			Skipped:  b.read - b.written - b.filtered,
+			Filtered: b.filtered,
+			Duration: time.Since(start),
+		})
+	}
+
+	for i := len(copies) - 1; i >= 0; i-- {
+		start := time.Now()
+		deleted, err := m.deleteMissing(ctx, tx, copies[i].name)
+		if err != nil {
+			return fmt.Errorf("deleting %s: %w", copies[i].name, err)
+		}
+
+		ts := &m.tables[i]
+		ts.Deleted = deleted
+		ts.Duration += time.Since(start)
+	}
+
+	for _, ts := range m.tables {
+		m.logf("  Synced %d changed %s and deleted %d", ts.Written, ts.Name, ts.Deleted)
+	}
+
+	m.logf("Checking full-text search index...")
+	if err := checkFTSIndex(ctx, tx); err != nil {
+		return fmt.Errorf("checking full-text search index: %w", err)
+	}
+
+	m.logf("Checking foreign keys...")
+	if err := checkForeignKeys(ctx, tx); err != nil {
+		return fmt.Errorf("checking foreign keys: %w", err)
+	}
+
+	if err := saveSyncMark(ctx, tx, now); err != nil {
+		return fmt.Errorf("saving sync mark: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+
+	return nil
+}
+
+// deleteMissing removes the rows of table that are gone from the source, or
+// that the orphan policy now leaves out, and returns how many it removed.
+func (m *Migrator) deleteMissing(ctx context.Context, tx *sql.Tx, table string) (int, error) {
+	ids := map[int]bool{}
+	err := scanSource(ctx, m.src, table, []string{"id"}, func(scan func(...any) error) error {
+		var id int
+		if err := scan(&id); err != nil {
+			return err
+		}
+		ids[id] = true
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %w", table, err)
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM "+table)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var gone []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		if !ids[id] || m.isDropped(table, id) {
+			gone = append(gone, id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, id := range gone {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE id = ?", id); err != nil {
+			return 0, fmt.Errorf("deleting row %d: %w", id, err)
+		}
+	}
+
+	return len(gone), nil
+}
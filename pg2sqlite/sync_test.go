@@ -0,0 +1,115 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// changedDump is testDump after the v2 server kept running: note 3 was
+// edited, note 1 was edited by a client that sent an old updated_at, note 5
+// was added and the session was signed out.
+func changedDump(dump string) string {
+	return strings.NewReplacer(
+		"\t10\tt\n", "\t12\tt\n",
+		"2024-01-04 03:04:05+00\t2024-01-04 03:04:05+00", "2024-01-04 03:04:05+00\t2024-07-01 00:00:00+00",
+		`second\tnote`, `second\tnote, edited`,
+		`use \\n for newlines`, `use \\n for line breaks`,
+		"\t'golang':1\tt\t2\tf\tf\tcli\n", "\t'golang':1\tt\t11\tf\tf\tcli\n"+
+			"5\t2024-07-02 00:00:00+00\t2024-07-02 00:00:00+00\te0000000-0000-4000-8000-000000000005\t1\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\tnew\t1719878400\t1719878400\t'new':1\tf\t12\tf\tf\tweb\n",
+		"1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t1\tsession123\t2024-01-02 03:04:05+00\t2024-02-02 03:04:05+00\n", "",
+	).Replace(dump)
+}
+
+func TestSync(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "server.db"))
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := mergeDump(t, db, testDump, Options{}); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	// A dump has no clock, so the time has to be given
+	if _, ok, err := SyncMark(context.Background(), db); !ok || err != nil {
+		t.Fatalf("Expected the migration to be syncable, got %v, %v", ok, err)
+	}
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, changedDump(testDump)))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+
+	_, err = New(src, db, Options{}).Sync(context.Background(), time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "no high-water mark was recorded") {
+		t.Errorf("Expected a missing mark to be reported, got %v", err)
+	}
+
+	result, err := New(src, db, Options{}).Sync(context.Background(), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	written := map[string]int{}
+	deleted := map[string]int{}
+	for _, ts := range result.Tables {
+		written[ts.Name] = ts.Written
+		deleted[ts.Name] = ts.Deleted
+	}
+	if written["users"] != 1 || written["notes"] != 3 || written["books"] != 0 || deleted["sessions"] != 1 {
+		t.Errorf("Expected 1 user and 3 notes written and 1 session deleted, got written %v, deleted %v", written, deleted)
+	}
+
+	var maxUSN int
+	if err := db.QueryRow("SELECT max_usn FROM users WHERE id = 1").Scan(&maxUSN); err != nil {
+		t.Fatalf("Failed to read user: %v", err)
+	}
+	if maxUSN != 12 {
+		t.Errorf("max_usn: expected 12, got %d", maxUSN)
+	}
+
+	// The full-text index follows the edits
+	for query, expected := range map[string]int{"breaks": 1, "newlines": 0, "edited": 1, "new": 1} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM notes_fts WHERE notes_fts MATCH ?", query).Scan(&n); err != nil {
+			t.Fatalf("Failed to search notes: %v", err)
+		}
+		if n != expected {
+			t.Errorf("%q: expected %d matches, got %d", query, expected, n)
+		}
+	}
+}
+
+func TestSyncRefusesOtherSettings(t *testing.T) {
+	opts := Options{Filter: Filter{UserEmails: []string{"user1@example.com"}, SkipTables: []string{"sessions"}}}
+	db, _, err := runFilteredMigration(t, testDump, opts)
+	if err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	src, err := OpenDumpSource(context.Background(), writeTestDump(t, changedDump(testDump)))
+	if err != nil {
+		t.Fatalf("Failed to open dump: %v", err)
+	}
+	defer src.Close()
+	since := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// Without the filter, the sync would copy every user into the database
+	for _, other := range []Options{{}, {Filter: opts.Filter, Encrypted: EncryptedSkip}} {
+		_, err = New(src, db, other).Sync(context.Background(), since)
+		if err == nil || !strings.Contains(err.Error(), "the target was migrated with --user-email=user1@example.com --tables=users,accounts,books,notes,tokens --encrypted=fail --orphans=fail") {
+			t.Errorf("Expected the sync with %+v to be refused, got %v", other, err)
+		}
+	}
+
+	// The same users, spelled differently, are the same settings
+	same := Options{Filter: Filter{UserEmails: []string{"USER1@example.com"}, Tables: []string{"users", "accounts", "books", "notes", "tokens"}}}
+	if _, err := New(src, db, same).Sync(context.Background(), since); err != nil {
+		t.Errorf("Sync with the migration's settings failed: %v", err)
+	}
+}
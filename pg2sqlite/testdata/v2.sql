@@ -0,0 +1,46 @@
+--
+-- PostgreSQL database dump
+--
+
+-- Dumped from database version 12.17
+-- Dumped by pg_dump version 12.17
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+
+COPY public.users (id, created_at, updated_at, uuid, last_login_at, max_usn, cloud) FROM stdin;
+2	2024-03-01 10:00:00.5+00	2024-03-01 10:00:00.5+00	0b4a4d7e-0e5c-4f7e-9a2b-6c1d2e3f4a5b	\N	0	f
+1	2024-01-02 03:04:05.123456+00	2024-01-03 03:04:05+00	7c9e6679-7425-40de-944b-e07fc1f90ae7	2024-02-01 00:00:00+09	10	t
+\.
+
+
+COPY public.accounts (id, created_at, updated_at, user_id, email, email_verified, password) FROM stdin;
+1	2024-01-02 03:04:05.123456+00	2024-01-02 03:04:05.123456+00	1	user1@example.com	t	hashedpassword1
+2	2024-03-01 10:00:00.5+00	2024-03-01 10:00:00.5+00	2	\N	f	\N
+\.
+
+
+COPY public.books (id, created_at, updated_at, uuid, user_id, label, added_on, edited_on, usn, deleted, encrypted) FROM stdin;
+1	2024-01-02 03:04:05+00	2024-01-02 03:04:05+00	2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b	1	golang	1704164645	1704164645	1	f	f
+\.
+
+
+COPY public.notes (id, created_at, updated_at, uuid, user_id, book_uuid, body, added_on, edited_on, tsv, public, usn, deleted, encrypted, client) FROM stdin;
+3	2024-01-04 03:04:05+00	2024-01-04 03:04:05+00	d1c2b3a4-1111-4222-8333-944455556666	1	2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b	second\tnote	1704337445	1704337445	'note':1 'second':2	f	3	f	f	web
+1	2024-01-02 03:04:05+00	2024-01-02 03:04:05+00	a1b2c3d4-1111-4222-8333-944455556666	1	2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b	# golang\nuse \\n for newlines	1704164645	1704164645	'golang':1	t	2	f	f	cli
+\.
+
+
+COPY public.tokens (id, created_at, updated_at, user_id, value, type, used_at) FROM stdin;
+1	2024-01-02 03:04:05+00	2024-01-02 03:04:05+00	1	token123	access	\N
+\.
+
+
+COPY public.sessions (id, created_at, updated_at, user_id, key, last_used_at, expires_at) FROM stdin;
+1	2024-01-02 03:04:05+00	2024-01-02 03:04:05+00	1	session123	2024-01-02 03:04:05+00	2024-02-02 03:04:05+00
+\.
+
+
+--
+-- PostgreSQL database dump complete
+--
@@ -0,0 +1,229 @@
+package pg2sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifyTable lists the columns of a table that are carried over from
+// Postgres and therefore must be identical on both sides.
+type verifyTable struct {
+	Name    string
+	Columns []string
+}
+
+var verifyTables = []verifyTable{
+	{Name: "users", Columns: []string{"id", "created_at", "updated_at", "uuid", "last_login_at", "max_usn"}},
+	{Name: "accounts", Columns: []string{"id", "created_at", "updated_at", "user_id", "email", "password"}},
+	{Name: "books", Columns: []string{"id", "created_at", "updated_at", "uuid", "user_id", "label", "added_on", "edited_on", "usn", "deleted"}},
+	{Name: "notes", Columns: []string{"id", "created_at", "updated_at", "uuid", "user_id", "book_uuid", "body", "added_on", "edited_on", "public", "usn", "deleted", "client"}},
+	{Name: "tokens", Columns: []string{"id", "created_at", "updated_at", "user_id", "value", "type", "used_at"}},
+	{Name: "sessions", Columns: []string{"id", "created_at", "updated_at", "user_id", "key", "last_used_at", "expires_at"}},
+}
+
+// VerifyReport is the machine-readable result of comparing a migrated SQLite
+// database against its Postgres source.
+type VerifyReport struct {
+	OK     bool        `json:"ok"`
+	Tables []TableDiff `json:"tables"`
+}
+
+// TableDiff describes the differences found in a single table.
+type TableDiff struct {
+	Table          string    `json:"table"`
+	OK             bool      `json:"ok"`
+	SourceRows     int       `json:"source_rows"`
+	TargetRows     int       `json:"target_rows"`
+	MissingIDs     []int     `json:"missing_ids"`
+	ExtraIDs       []int     `json:"extra_ids"`
+	MismatchedRows []RowDiff `json:"mismatched_rows"`
+}
+
+// RowDiff describes a row present on both sides whose hashes differ.
+type RowDiff struct {
+	ID         int      `json:"id"`
+	SourceHash string   `json:"source_hash"`
+	TargetHash string   `json:"target_hash"`
+	Columns    []string `json:"columns"`
+}
+
+// verifiedRow is a row with every column normalized to a comparable string.
+type verifiedRow struct {
+	id     int
+	values []string
+}
+
+// Verify compares a migrated SQLite database with the Postgres database it
+// was migrated from, row by row. It never writes to either database, and
+// stops once ctx is done.
+func Verify(ctx context.Context, pgDB, sqliteDB *sql.DB) (*VerifyReport, error) {
+	report := VerifyReport{OK: true}
+
+	for _, t := range verifyTables {
+		diff, err := verifyTableRows(ctx, pgDB, sqliteDB, t)
+		if err != nil {
+			return nil, fmt.Errorf("verifying %s: %w", t.Name, err)
+		}
+
+		if !diff.OK {
+			report.OK = false
+		}
+		report.Tables = append(report.Tables, *diff)
+	}
+
+	return &report, nil
+}
+
+// verifyTableRows walks both tables in id order at the same time, so neither
+// side has to be held in memory.
+func verifyTableRows(ctx context.Context, pgDB, sqliteDB *sql.DB, t verifyTable) (*TableDiff, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s ORDER BY id", strings.Join(t.Columns, ", "), t.Name)
+
+	srcRows, err := pgDB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("querying source: %w", err)
+	}
+	defer srcRows.Close()
+
+	dstRows, err := sqliteDB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("querying target: %w", err)
+	}
+	defer dstRows.Close()
+
+	diff := TableDiff{
+		Table:          t.Name,
+		MissingIDs:     []int{},
+		ExtraIDs:       []int{},
+		MismatchedRows: []RowDiff{},
+	}
+
+	src, err := nextVerifiedRow(srcRows, len(t.Columns))
+	if err != nil {
+		return nil, fmt.Errorf("reading source: %w", err)
+	}
+	dst, err := nextVerifiedRow(dstRows, len(t.Columns))
+	if err != nil {
+		return nil, fmt.Errorf("reading target: %w", err)
+	}
+
+	for src != nil || dst != nil {
+		advanceSrc, advanceDst := false, false
+
+		switch {
+		case dst == nil || (src != nil && src.id < dst.id):
+			diff.MissingIDs = append(diff.MissingIDs, src.id)
+			advanceSrc = true
+		case src == nil || dst.id < src.id:
+			diff.ExtraIDs = append(diff.ExtraIDs, dst.id)
+			advanceDst = true
+		default:
+			srcHash, dstHash := hashRow(src.values), hashRow(dst.values)
+			if srcHash != dstHash {
+				diff.MismatchedRows = append(diff.MismatchedRows, RowDiff{
+					ID:         src.id,
+					SourceHash: srcHash,
+					TargetHash: dstHash,
+					Columns:    diffColumns(t.Columns, src.values, dst.values),
+				})
+			}
+			advanceSrc, advanceDst = true, true
+		}
+
+		if advanceSrc {
+			diff.SourceRows++
+			if src, err = nextVerifiedRow(srcRows, len(t.Columns)); err != nil {
+				return nil, fmt.Errorf("reading source: %w", err)
+			}
+		}
+		if advanceDst {
+			diff.TargetRows++
+			if dst, err = nextVerifiedRow(dstRows, len(t.Columns)); err != nil {
+				return nil, fmt.Errorf("reading target: %w", err)
+			}
+		}
+	}
+
+	diff.OK = len(diff.MissingIDs) == 0 && len(diff.ExtraIDs) == 0 && len(diff.MismatchedRows) == 0
+
+	return &diff, nil
+}
+
+// nextVerifiedRow returns the next row of rows, or nil once they are
+// exhausted. The first column must be the integer id.
+func nextVerifiedRow(rows *sql.Rows, numColumns int) (*verifiedRow, error) {
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]any, numColumns)
+	dest := make([]any, numColumns)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := verifiedRow{values: make([]string, numColumns)}
+	for i, v := range values {
+		row.values[i] = normalizeValue(v)
+	}
+
+	id, err := strconv.Atoi(row.values[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing id %q: %w", row.values[0], err)
+	}
+	row.id = id
+
+	return &row, nil
+}
+
+// normalizeValue renders a value scanned from either driver in a form that
+// compares equal across them. Postgres stores timestamps with microsecond
+// precision and SQLite stores booleans as integers.
+func normalizeValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "\x00NULL"
+	case time.Time:
+		return v.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func hashRow(values []string) string {
+	h := sha256.New()
+	for _, v := range values {
+		fmt.Fprintf(h, "%d:%s", len(v), v)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func diffColumns(columns, src, dst []string) []string {
+	var ret []string
+	for i, c := range columns {
+		if src[i] != dst[i] {
+			ret = append(ret, c)
+		}
+	}
+
+	return ret
+}
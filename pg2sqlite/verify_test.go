@@ -0,0 +1,86 @@
+package pg2sqlite
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestSQLite(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name))
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := initSchema(context.Background(), db); err != nil {
+		t.Fatalf("Failed to create schema for %s: %v", name, err)
+	}
+
+	return db
+}
+
+func TestVerifyTableRows(t *testing.T) {
+	src := openTestSQLite(t, "source.db")
+	dst := openTestSQLite(t, "target.db")
+
+	now := time.Now()
+	insertBook := `INSERT INTO books (id, created_at, updated_at, uuid, user_id, label, added_on, edited_on, usn, deleted)
+		VALUES (?, ?, ?, ?, 1, ?, 0, 0, 1, ?)`
+
+	for _, db := range []*sql.DB{src, dst} {
+		if _, err := db.Exec(insertBook, 1, now, now, "uuid-1", "golang", false); err != nil {
+			t.Fatalf("Failed to insert book 1: %v", err)
+		}
+	}
+	// Only in the source
+	if _, err := src.Exec(insertBook, 2, now, now, "uuid-2", "rust", false); err != nil {
+		t.Fatalf("Failed to insert book 2: %v", err)
+	}
+	// Different label and deleted flag
+	if _, err := src.Exec(insertBook, 3, now, now, "uuid-3", "js", false); err != nil {
+		t.Fatalf("Failed to insert book 3: %v", err)
+	}
+	if _, err := dst.Exec(insertBook, 3, now.In(time.FixedZone("X", 3600)), now, "uuid-3", "javascript", true); err != nil {
+		t.Fatalf("Failed to insert book 3: %v", err)
+	}
+	// Only in the target
+	if _, err := dst.Exec(insertBook, 4, now, now, "uuid-4", "python", false); err != nil {
+		t.Fatalf("Failed to insert book 4: %v", err)
+	}
+
+	var table verifyTable
+	for _, vt := range verifyTables {
+		if vt.Name == "books" {
+			table = vt
+		}
+	}
+
+	diff, err := verifyTableRows(context.Background(), src, dst, table)
+	if err != nil {
+		t.Fatalf("verifyTableRows failed: %v", err)
+	}
+
+	if diff.OK {
+		t.Error("expected diff not to be OK")
+	}
+	if diff.SourceRows != 3 || diff.TargetRows != 3 {
+		t.Errorf("row counts: expected 3/3, got %d/%d", diff.SourceRows, diff.TargetRows)
+	}
+	if len(diff.MissingIDs) != 1 || diff.MissingIDs[0] != 2 {
+		t.Errorf("MissingIDs: expected [2], got %v", diff.MissingIDs)
+	}
+	if len(diff.ExtraIDs) != 1 || diff.ExtraIDs[0] != 4 {
+		t.Errorf("ExtraIDs: expected [4], got %v", diff.ExtraIDs)
+	}
+	if len(diff.MismatchedRows) != 1 {
+		t.Fatalf("MismatchedRows: expected 1, got %d", len(diff.MismatchedRows))
+	}
+	// created_at differs only by time zone, which is normalized away
+	mismatch := diff.MismatchedRows[0]
+	if mismatch.ID != 3 || len(mismatch.Columns) != 2 || mismatch.Columns[0] != "label" || mismatch.Columns[1] != "deleted" {
+		t.Errorf("MismatchedRows[0]: expected id 3 with [label deleted], got %d with %v", mismatch.ID, mismatch.Columns)
+	}
+}
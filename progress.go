@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+	"golang.org/x/term"
+)
+
+// out receives the human-readable output of a migration. --progress=json
+// moves it to stderr, so that stdout carries nothing but events.
+var out io.Writer = os.Stdout
+
+// Values of --progress.
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressLog  = "log"
+	progressJSON = "json"
+	progressNone = "none"
+)
+
+const (
+	// barRedrawInterval keeps a fast copy from spending its time redrawing
+	barRedrawInterval = 100 * time.Millisecond
+	// progressLogInterval is how often a table's progress is logged when
+	// there is no terminal to draw a bar on
+	progressLogInterval = 10 * time.Second
+
+	barWidth = 30
+)
+
+func validProgressMode(mode string) bool {
+	switch mode {
+	case progressAuto, progressBar, progressLog, progressJSON, progressNone:
+		return true
+	}
+
+	return false
+}
+
+// newProgressReporter returns the Options.Progress callback for mode, which
+// writes to w. auto draws a bar if stdout is a terminal and logs otherwise.
+func newProgressReporter(mode string, w io.Writer) func(pg2sqlite.Progress) {
+	if mode == progressAuto {
+		mode = progressLog
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			mode = progressBar
+		}
+	}
+
+	switch mode {
+	case progressBar:
+		return (&barReporter{w: w}).report
+	case progressLog:
+		return (&logReporter{w: w}).report
+	case progressJSON:
+		return (&jsonReporter{enc: json.NewEncoder(w)}).report
+	}
+
+	return nil
+}
+
+// barReporter redraws a progress bar for the table being copied on a single
+// terminal line, and moves to the next line once the table is done.
+type barReporter struct {
+	w    io.Writer
+	last time.Duration // elapsed time of the last redraw
+}
+
+func (r *barReporter) report(p pg2sqlite.Progress) {
+	if !p.Done && p.Elapsed-r.last < barRedrawInterval && r.last > 0 {
+		return
+	}
+	r.last = p.Elapsed
+
+	filled := barWidth
+	percent := 100
+	if p.Total > 0 && p.Read < p.Total {
+		filled = barWidth * p.Read / p.Total
+		percent = 100 * p.Read / p.Total
+	}
+
+	// \r returns to the start of the line and \033[K clears what is left
+	fmt.Fprintf(r.w, "\r\033[K  %-9s [%s%s] %3d%%  %s", p.Table+":",
+		strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled), percent, progressStatus(p))
+	if p.Done {
+		fmt.Fprintln(r.w)
+		r.last = 0
+	}
+}
+
+// logReporter logs the progress of a table every progressLogInterval.
+type logReporter struct {
+	w    io.Writer
+	last time.Duration // elapsed time of the last line
+}
+
+func (r *logReporter) report(p pg2sqlite.Progress) {
+	if p.Done {
+		r.last = 0
+		return
+	}
+	if p.Elapsed-r.last < progressLogInterval {
+		return
+	}
+	r.last = p.Elapsed
+
+	fmt.Fprintf(r.w, "  %s: %s\n", p.Table, progressStatus(p))
+}
+
+// progressStatus describes p as rows done, data read, rate and time left.
+func progressStatus(p pg2sqlite.Progress) string {
+	status := fmt.Sprintf("%d/%d rows, %s, %.0f rows/s", p.Read, p.Total, formatBytes(p.Bytes), p.Rate())
+	if eta := p.ETA().Round(time.Second); eta > 0 {
+		status += ", ETA " + eta.String()
+	}
+
+	return status
+}
+
+// progressEvent is the JSON line written for every progress update.
+type progressEvent struct {
+	Event      string  `json:"event"`
+	Table      string  `json:"table"`
+	Rows       int     `json:"rows"`
+	Read       int     `json:"read"`
+	Total      int     `json:"total"`
+	Bytes      int64   `json:"bytes"`
+	ElapsedMS  int64   `json:"elapsed_ms"`
+	RowsPerSec float64 `json:"rows_per_sec"`
+	ETAMS      int64   `json:"eta_ms"`
+	Done       bool    `json:"done"`
+}
+
+// jsonReporter writes every progress update as a JSON line.
+type jsonReporter struct {
+	enc *json.Encoder
+}
+
+func (r *jsonReporter) report(p pg2sqlite.Progress) {
+	// A reader that went away must not stop the migration
+	_ = r.enc.Encode(progressEvent{
+		Event:      "progress",
+		Table:      p.Table,
+		Rows:       p.Rows,
+		Read:       p.Read,
+		Total:      p.Total,
+		Bytes:      p.Bytes,
+		ElapsedMS:  p.Elapsed.Milliseconds(),
+		RowsPerSec: p.Rate(),
+		ETAMS:      p.ETA().Milliseconds(),
+		Done:       p.Done,
+	})
+}
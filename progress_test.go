@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+func TestLogReporter(t *testing.T) {
+	var buf bytes.Buffer
+	report := newProgressReporter(progressLog, &buf)
+
+	for _, elapsed := range []time.Duration{time.Second, 10 * time.Second, 15 * time.Second, 21 * time.Second} {
+		report(pg2sqlite.Progress{Table: "notes", Read: 100, Total: 400, Bytes: 2048, Elapsed: elapsed})
+	}
+	report(pg2sqlite.Progress{Table: "notes", Read: 400, Total: 400, Elapsed: 30 * time.Second, Done: true})
+
+	// Logged once the interval has passed, and again an interval later
+	expected := "  notes: 100/400 rows, 2.0 KB, 10 rows/s, ETA 30s\n" +
+		"  notes: 100/400 rows, 2.0 KB, 5 rows/s, ETA 1m3s\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestBarReporter(t *testing.T) {
+	var buf bytes.Buffer
+	report := newProgressReporter(progressBar, &buf)
+
+	report(pg2sqlite.Progress{Table: "notes", Read: 50, Total: 100, Elapsed: time.Second})
+	report(pg2sqlite.Progress{Table: "notes", Read: 60, Total: 100, Elapsed: time.Second + time.Millisecond})
+	report(pg2sqlite.Progress{Table: "notes", Read: 100, Total: 100, Elapsed: 2 * time.Second, Done: true})
+
+	lines := strings.Split(buf.String(), "\r\033[K")
+	if len(lines) != 3 {
+		t.Fatalf("expected 2 redraws, got %q", buf.String())
+	}
+	if !strings.Contains(lines[1], "[###############---------------]  50%") {
+		t.Errorf("unexpected bar %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "100%  100/100 rows, 0 B, 50 rows/s\n") {
+		t.Errorf("expected the finished bar to end its line, got %q", lines[2])
+	}
+}
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	report := newProgressReporter(progressJSON, &buf)
+
+	report(pg2sqlite.Progress{Table: "books", Rows: 10, Read: 10, Total: 40, Bytes: 500, Elapsed: 2 * time.Second})
+
+	var event progressEvent
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("Failed to decode event %q: %v", buf.String(), err)
+	}
+
+	expected := progressEvent{Event: "progress", Table: "books", Rows: 10, Read: 10, Total: 40, Bytes: 500, ElapsedMS: 2000, RowsPerSec: 5, ETAMS: 6000}
+	if event != expected {
+		t.Errorf("expected %+v, got %+v", expected, event)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+// migrationReport is the record of a run written by --report. Admins attach
+// it to upgrade tickets, so it holds everything needed to tell what was
+// migrated from where, and what was left behind.
+type migrationReport struct {
+	ToolVersion string    `json:"tool_version"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	DurationMS  int64     `json:"duration_ms"`
+	// Status is "succeeded" or "failed"
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	Source   reportSource   `json:"source"`
+	Output   *reportOutput  `json:"output,omitempty"`
+	Policies reportPolicies `json:"policies"`
+	Filter   *reportFilter  `json:"filter,omitempty"`
+
+	Tables    []reportTable    `json:"tables"`
+	Encrypted *reportEncrypted `json:"encrypted,omitempty"`
+	Orphans   *reportOrphans   `json:"orphans,omitempty"`
+	// Unverified lists the accounts that were verified in the source, as
+	// the v3 schema does not record verified emails
+	Unverified []int              `json:"unverified_accounts"`
+	Merge      *reportMerge       `json:"merge,omitempty"`
+	Skipped    []reportSkippedRow `json:"skipped_rows"`
+	Warnings   []string           `json:"warnings"`
+}
+
+type reportSource struct {
+	// Kind is "postgres" or "pg_dump"
+	Kind     string `json:"kind"`
+	Host     string `json:"host,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Database string `json:"database,omitempty"`
+	DumpFile string `json:"dump_file,omitempty"`
+
+	ServerVersion     string   `json:"server_version,omitempty"`
+	SchemaVersion     string   `json:"schema_version,omitempty"`
+	SchemaFingerprint string   `json:"schema_fingerprint,omitempty"`
+	Migrations        []string `json:"migrations,omitempty"`
+}
+
+type reportOutput struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type reportPolicies struct {
+	Encrypted string `json:"encrypted"`
+	Orphans   string `json:"orphans"`
+}
+
+type reportFilter struct {
+	UserUUIDs  []string `json:"user_uuids,omitempty"`
+	UserEmails []string `json:"user_emails,omitempty"`
+	Tables     []string `json:"tables,omitempty"`
+	SkipTables []string `json:"skip_tables,omitempty"`
+}
+
+type reportTable struct {
+	Name           string   `json:"name"`
+	Read           int      `json:"read"`
+	Written        int      `json:"written"`
+	Skipped        int      `json:"skipped"`
+	Filtered       int      `json:"filtered"`
+	Deleted        int      `json:"deleted"`
+	DurationMS     int64    `json:"duration_ms"`
+	DroppedColumns []string `json:"dropped_columns"`
+}
+
+type reportEncrypted struct {
+	Books   int    `json:"books"`
+	Notes   int    `json:"notes"`
+	Outcome string `json:"outcome"`
+}
+
+type reportOrphans struct {
+	BooksWithoutUser    int `json:"books_without_user"`
+	NotesWithoutUser    int `json:"notes_without_user"`
+	NotesWithoutBook    int `json:"notes_without_book"`
+	AccountsWithoutUser int `json:"accounts_without_user"`
+	TokensWithoutUser   int `json:"tokens_without_user"`
+	SessionsWithoutUser int `json:"sessions_without_user"`
+	Dropped             int `json:"dropped"`
+	Reparented          int `json:"reparented"`
+	RecoveredBooks      int `json:"recovered_books"`
+}
+
+// reportMerge lists every change made to fit the source into the database
+// it was merged into.
+type reportMerge struct {
+	Users []reportMergedUser  `json:"users"`
+	IDs   []reportRemappedID  `json:"ids"`
+	Books []reportRenamedBook `json:"books"`
+	USNs  []reportRebasedUSN  `json:"usns"`
+}
+
+type reportMergedUser struct {
+	Email    string `json:"email"`
+	SourceID int    `json:"source_id"`
+	TargetID int    `json:"target_id"`
+}
+
+type reportRemappedID struct {
+	Table string `json:"table"`
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+}
+
+type reportRenamedBook struct {
+	UUID   string `json:"uuid"`
+	UserID int    `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+type reportRebasedUSN struct {
+	UserID int `json:"user_id"`
+	Offset int `json:"offset"`
+}
+
+type reportSkippedRow struct {
+	Table  string `json:"table"`
+	ID     int    `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// newReport describes a run of config that started at started and ended with
+// err. result is nil if the migration itself did not complete.
+func newReport(config Config, started time.Time, result *pg2sqlite.Result, err error) (*migrationReport, error) {
+	finished := time.Now()
+	encrypted, _ := config.encryptedPolicy()
+	orphans, _ := config.orphanPolicy()
+
+	r := &migrationReport{
+		ToolVersion: version,
+		StartedAt:   started.UTC(),
+		FinishedAt:  finished.UTC(),
+		DurationMS:  finished.Sub(started).Milliseconds(),
+		Status:      "succeeded",
+		Policies:    reportPolicies{Encrypted: string(encrypted), Orphans: string(orphans)},
+		Tables:      []reportTable{},
+		Skipped:     []reportSkippedRow{},
+		Unverified:  []int{},
+		Warnings:    []string{},
+	}
+	if err != nil {
+		r.Status = "failed"
+		r.Error = err.Error()
+	}
+
+	if f := config.filter(); len(f.UserUUIDs)+len(f.UserEmails)+len(f.Tables)+len(f.SkipTables) > 0 {
+		r.Filter = &reportFilter{UserUUIDs: f.UserUUIDs, UserEmails: f.UserEmails, Tables: f.Tables, SkipTables: f.SkipTables}
+	}
+
+	if config.PgDumpFile != "" {
+		r.Source = reportSource{Kind: "pg_dump", DumpFile: config.PgDumpFile}
+	} else {
+		r.Source = reportSource{Kind: "postgres", Host: config.PgHost, Port: config.PgPort, Database: config.PgDatabase}
+	}
+
+	if result == nil {
+		return r, nil
+	}
+
+	if s := result.Schema; s != nil {
+		r.Source.ServerVersion = s.ServerVersion
+		r.Source.SchemaVersion = s.Version
+		r.Source.SchemaFingerprint = s.Fingerprint
+		r.Source.Migrations = s.Migrations
+	}
+
+	for _, t := range result.Tables {
+		dropped := t.DroppedColumns
+		if dropped == nil {
+			dropped = []string{}
+		}
+		r.Tables = append(r.Tables, reportTable{
+			Name:           t.Name,
+			Read:           t.Read,
+			Written:        t.Written,
+			Skipped:        t.Skipped,
+			Filtered:       t.Filtered,
+			Deleted:        t.Deleted,
+			DurationMS:     t.Duration.Milliseconds(),
+			DroppedColumns: dropped,
+		})
+	}
+
+	stats := result.Stats
+	if stats.EncryptedBooks > 0 || stats.EncryptedNotes > 0 {
+		r.Encrypted = &reportEncrypted{Books: stats.EncryptedBooks, Notes: stats.EncryptedNotes, Outcome: encrypted.Outcome()}
+	}
+	if o := stats.Orphans; o.Total() > 0 {
+		r.Orphans = &reportOrphans{
+			BooksWithoutUser:    o.BooksWithoutUser,
+			NotesWithoutUser:    o.NotesWithoutUser,
+			NotesWithoutBook:    o.NotesWithoutBook,
+			AccountsWithoutUser: o.AccountsWithoutUser,
+			TokensWithoutUser:   o.TokensWithoutUser,
+			SessionsWithoutUser: o.SessionsWithoutUser,
+			Dropped:             o.Dropped,
+			Reparented:          o.Reparented,
+			RecoveredBooks:      o.RecoveredBooks,
+		}
+	}
+
+	if m := result.Merge; m != nil {
+		r.Merge = &reportMerge{
+			Users: []reportMergedUser{},
+			IDs:   []reportRemappedID{},
+			Books: []reportRenamedBook{},
+			USNs:  []reportRebasedUSN{},
+		}
+		for _, u := range m.Users {
+			r.Merge.Users = append(r.Merge.Users, reportMergedUser{Email: u.Email, SourceID: u.SourceID, TargetID: u.TargetID})
+		}
+		for _, id := range m.IDs {
+			r.Merge.IDs = append(r.Merge.IDs, reportRemappedID{Table: id.Table, From: id.From, To: id.To})
+		}
+		for _, b := range m.Books {
+			r.Merge.Books = append(r.Merge.Books, reportRenamedBook{UUID: b.UUID, UserID: b.UserID, From: b.From, To: b.To})
+		}
+		for _, u := range m.USNs {
+			r.Merge.USNs = append(r.Merge.USNs, reportRebasedUSN{UserID: u.UserID, Offset: u.Offset})
+		}
+	}
+
+	r.Unverified = append(r.Unverified, result.Unverified...)
+	for _, s := range result.Skipped {
+		r.Skipped = append(r.Skipped, reportSkippedRow{Table: s.Table, ID: s.ID, Reason: s.Reason})
+	}
+	r.Warnings = append(r.Warnings, result.Warnings...)
+
+	// The output only exists once the migration has been moved into place
+	if err == nil {
+		size, sum, err := fileSHA256(config.SqlitePath)
+		if err != nil {
+			return nil, fmt.Errorf("hashing output: %w", err)
+		}
+		r.Output = &reportOutput{Path: config.SqlitePath, Size: size, SHA256: sum}
+	}
+
+	return r, nil
+}
+
+// writeReport writes the report of a run to config.Report.
+func writeReport(config Config, started time.Time, result *pg2sqlite.Result, err error) error {
+	r, reportErr := newReport(config, started, result, err)
+	if reportErr != nil {
+		return reportErr
+	}
+
+	data, reportErr := json.MarshalIndent(r, "", "  ")
+	if reportErr != nil {
+		return reportErr
+	}
+
+	return os.WriteFile(config.Report, append(data, '\n'), 0644)
+}
+
+// fileSHA256 returns the size and hex-encoded SHA-256 of the file at path.
+func fileSHA256(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readReport(t *testing.T, path string) migrationReport {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read report: %v", err)
+	}
+
+	var r migrationReport
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("Failed to parse report: %v", err)
+	}
+
+	return r
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		PgDumpFile: writeTestDump(t, testDump),
+		SqlitePath: filepath.Join(dir, "server.db"),
+		Report:     filepath.Join(dir, "report.json"),
+	}
+
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	r := readReport(t, config.Report)
+	if r.Status != "succeeded" || r.Error != "" {
+		t.Errorf("Expected a successful run, got %q (%q)", r.Status, r.Error)
+	}
+	if r.ToolVersion != version {
+		t.Errorf("tool_version: expected %q, got %q", version, r.ToolVersion)
+	}
+	if r.Source.Kind != "pg_dump" || r.Source.DumpFile != config.PgDumpFile {
+		t.Errorf("Unexpected source %+v", r.Source)
+	}
+	if r.Source.ServerVersion != "12.17" {
+		t.Errorf("server_version: expected 12.17, got %q", r.Source.ServerVersion)
+	}
+	if !strings.HasPrefix(r.Source.SchemaFingerprint, "sha256:") {
+		t.Errorf("Unexpected schema_fingerprint %q", r.Source.SchemaFingerprint)
+	}
+
+	size, sum, err := fileSHA256(config.SqlitePath)
+	if err != nil {
+		t.Fatalf("Failed to hash output: %v", err)
+	}
+	if r.Output == nil || r.Output.SHA256 != sum || r.Output.Size != size {
+		t.Errorf("output: expected sha256 %s and size %d, got %+v", sum, size, r.Output)
+	}
+
+	written := map[string]int{}
+	for _, table := range r.Tables {
+		written[table.Name] = table.Written
+	}
+	for table, expected := range map[string]int{
+		"users": 2, "accounts": 2, "books": 1, "notes": 2, "tokens": 1, "sessions": 1,
+	} {
+		if written[table] != expected {
+			t.Errorf("%s: expected %d rows written, got %d", table, expected, written[table])
+		}
+	}
+	if fmt.Sprint(r.Unverified) != "[1]" {
+		t.Errorf("unverified_accounts: expected [1], got %v", r.Unverified)
+	}
+}
+
+func TestReportFailedRun(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{
+		PgDumpFile: writeTestDump(t, brokenTestDump),
+		SqlitePath: filepath.Join(dir, "server.db"),
+		Report:     filepath.Join(dir, "report.json"),
+	}
+
+	if err := run(context.Background(), config); err == nil {
+		t.Fatal("expected the migration to fail")
+	}
+
+	r := readReport(t, config.Report)
+	if r.Status != "failed" || r.Error == "" {
+		t.Errorf("Expected a failed run with its error, got %q (%q)", r.Status, r.Error)
+	}
+	if r.Output != nil {
+		t.Errorf("Expected no output, got %+v", r.Output)
+	}
+}
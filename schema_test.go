@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreflightOldSchema(t *testing.T) {
+	// Drop users.cloud and notes.client, and add a column v2 never had
+	dump := strings.Replace(testDump,
+		"COPY public.users (id, created_at, updated_at, uuid, last_login_at, max_usn, cloud) FROM stdin;",
+		"COPY public.users (id, created_at, updated_at, uuid, last_login_at, max_usn, legacy) FROM stdin;", 1)
+	dump = strings.Replace(dump, "deleted, encrypted, client) FROM stdin;", "deleted, encrypted, cli) FROM stdin;", 1)
+
+	config := Config{
+		PgDumpFile: writeTestDump(t, dump),
+		SqlitePath: filepath.Join(t.TempDir(), "data", "server.db"),
+	}
+
+	err := run(context.Background(), config)
+	if err == nil {
+		t.Fatal("expected the migration to refuse an old schema")
+	}
+	for _, expected := range []string{"older than v2", "users: missing columns cloud; unexpected columns legacy", "notes: missing columns client", "Upgrade to Dnote server v2.x"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error should mention %q, got: %v", expected, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Dir(config.SqlitePath)); !os.IsNotExist(err) {
+		t.Errorf("expected the SQLite directory not to be created, got %v", err)
+	}
+}
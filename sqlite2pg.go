@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+// sqlite2pgMain runs the sqlite2pg subcommand, which copies a Dnote v3
+// database back into Postgres to go back to Dnote v2.
+func sqlite2pgMain(args []string) {
+	var config Config
+
+	fs := flag.NewFlagSet("sqlite2pg", flag.ExitOnError)
+	registerFlags(fs, &config)
+	fs.IntVar(&config.BatchSize, "batch-size", pg2sqlite.DefaultBatchSize, "Number of rows inserted into PostgreSQL at a time")
+	fs.StringVar(&config.Progress, "progress", progressAuto, "How to report progress: auto (a bar on a terminal, log lines otherwise), bar, log, json or none")
+	fs.Parse(args)
+
+	if err := resolve(&config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validate(config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	if config.Progress == progressJSON {
+		out = os.Stderr
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	if _, err := runSQLite2PG(ctx, config); err != nil {
+		log.Fatalf("Rollback failed: %v", err)
+	}
+
+	fmt.Fprintln(out, "\nRollback completed successfully!")
+}
+
+// runSQLite2PG copies the Dnote v3 database at config.SqlitePath into the
+// Dnote v2 schema of the Postgres database described by config. It never
+// writes to the SQLite database, and writes to Postgres in one transaction.
+func runSQLite2PG(ctx context.Context, config Config) (*pg2sqlite.Result, error) {
+	if _, err := os.Stat(config.SqlitePath); err != nil {
+		return nil, fmt.Errorf("checking SQLite database: %w", err)
+	}
+
+	sqliteDB, err := sql.Open("sqlite3", "file:"+config.SqlitePath+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer sqliteDB.Close()
+
+	pgDB, err := openPostgres(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer pgDB.Close()
+
+	result, err := pg2sqlite.Rollback(ctx, sqliteDB, pgDB, pg2sqlite.RollbackOptions{
+		BatchSize: config.BatchSize,
+		Progress:  newProgressReporter(config.Progress, os.Stdout),
+		Logf:      logln,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	printSummary("Rollback Summary", result, "")
+	return result, nil
+}
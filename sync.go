@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/dnote/dnote-pg2sqlite/pg2sqlite"
+)
+
+// runSync brings the database at config.SqlitePath up to date with the
+// source. It writes in place, in a single transaction, so a failed or
+// stopped sync leaves the database as it was.
+func runSync(ctx context.Context, config Config) (*pg2sqlite.Result, error) {
+	if _, err := os.Stat(config.SqlitePath); err != nil {
+		return nil, fmt.Errorf("checking SQLite database to sync: %w", err)
+	}
+
+	since, err := config.syncSince()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := config.encryptedPolicy()
+	if err != nil {
+		return nil, err
+	}
+	orphans, err := config.orphanPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := openSource(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	sqliteDB, err := sql.Open("sqlite3", config.SqlitePath+"?_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("opening SQLite: %w", err)
+	}
+	defer sqliteDB.Close()
+	sqliteDB.SetMaxOpenConns(1)
+
+	opts := pg2sqlite.Options{
+		Encrypted: encrypted,
+		Orphans:   orphans,
+		Filter:    config.filter(),
+		Logf:      logln,
+	}
+	if config.EncryptedExport != "" {
+		export := &exportFile{path: config.EncryptedExport}
+		defer export.Close()
+
+		opts.EncryptedExport = export
+	}
+
+	result, err := pg2sqlite.New(src, sqliteDB, opts).Sync(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+
+	printSummary("Sync Summary", result, encrypted)
+	return result, nil
+}
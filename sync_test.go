@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	dumpPath := writeTestDump(t, testDump)
+	config := Config{
+		PgDumpFile: dumpPath,
+		SqlitePath: filepath.Join(t.TempDir(), "server.db"),
+	}
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	// The session was signed out and the book renamed while the copy ran
+	changed := strings.Replace(testDump, "1\t2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t1\tsession123\t2024-01-02 03:04:05+00\t2024-02-02 03:04:05+00\n", "", 1)
+	changed = strings.Replace(changed, "2024-01-02 03:04:05+00\t2024-01-02 03:04:05+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgolang\t1704164645\t1704164645\t1\t",
+		"2024-01-02 03:04:05+00\t2024-07-01 00:00:00+00\t2f3a1b4c-5d6e-4f70-8a9b-0c1d2e3f4a5b\t1\tgo\t1704164645\t1719792000\t11\t", 1)
+	config.PgDumpFile = writeTestDump(t, changed)
+
+	// A dump records no mark, so the time has to be given
+	config.SyncSince = "last"
+	if err := run(context.Background(), config); err == nil || !strings.Contains(err.Error(), "no high-water mark") {
+		t.Errorf("Expected a missing mark to be reported, got %v", err)
+	}
+
+	config.SyncSince = "2024-06-01T00:00:00Z"
+	if err := run(context.Background(), config); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+
+	if n := countRows(t, config.SqlitePath, "sessions"); n != 0 {
+		t.Errorf("sessions: expected 0, got %d", n)
+	}
+	if n := countRows(t, config.SqlitePath, "books WHERE label = 'go'"); n != 1 {
+		t.Errorf("Expected the book to be renamed to go, got %d such books", n)
+	}
+
+	config.Merge = true
+	if err := validate(config); err == nil {
+		t.Error("expected --sync-since with --merge to be rejected")
+	}
+	config.Merge = false
+	config.SyncSince = "yesterday"
+	if err := validate(config); err == nil {
+		t.Error("expected an invalid --sync-since to be rejected")
+	}
+}